@@ -195,12 +195,7 @@ func main() {
 					done <- true
 					return
 				case syscall.SIGHUP:
-					cfg, err := loadConfig()
-					if err != nil {
-						log.Warn("Failed to reload config", zap.Error(err))
-						break
-					}
-					err = cr.Reload(cfg)
+					err := cr.ReloadFrom(loadConfig)
 					if err == nil {
 						log.Info("Config reloaded")
 					} else {
@@ -232,6 +227,15 @@ func main() {
 		}()
 	}
 
+	if cfg.Watch {
+		go func() {
+			err := cr.Watch(*configPath, loadConfig)
+			if err != nil {
+				log.Error("Failed to watch config files", zap.Error(err))
+			}
+		}()
+	}
+
 	err = cr.Run()
 	if err != nil {
 		log.Fatal("Failed to run cradle", zap.Error(err))
@@ -5,14 +5,18 @@ go 1.15
 require (
 	github.com/facebookgo/atomicfile v0.0.0-20151019160806-2de1f203e7d5 // indirect
 	github.com/facebookgo/pidfile v0.0.0-20150612191647-f242e2999868
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/golang/protobuf v1.3.2
 	github.com/gorilla/mux v1.8.0
+	github.com/klauspost/compress v1.11.13
 	github.com/mattn/go-isatty v0.0.12
 	github.com/prometheus/client_golang v1.0.0
-	github.com/prometheus/common v0.10.0 // indirect
+	github.com/prometheus/client_model v0.2.0
+	github.com/prometheus/common v0.10.0
 	github.com/robfig/cron v1.2.0
 	go.uber.org/atomic v1.6.0
 	go.uber.org/zap v1.16.0
-	golang.org/x/sys v0.0.0-20200223170610-d5e6a3e2c0ae // indirect
+	golang.org/x/sys v0.0.0-20200223170610-d5e6a3e2c0ae
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
 	gopkg.in/yaml.v2 v2.2.8
 )
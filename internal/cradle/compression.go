@@ -0,0 +1,115 @@
+package cradle
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// acceptEncoding is sent to endpoints to ask for compressed bodies, which decodeBody decompresses.
+const acceptEncoding = "zstd, gzip"
+
+// supportedEncodings are the content codings the probe responses can be compressed with, in preference order.
+var supportedEncodings = []string{"zstd", "gzip"}
+
+// negotiateEncoding picks the content coding for the response from the Accept-Encoding header.
+// It returns "" when the response should not be compressed.
+func negotiateEncoding(header string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(header, ",") {
+		coding := part
+		q := 1.0
+		if idx := strings.Index(part, ";"); idx >= 0 {
+			coding = part[:idx]
+			param := strings.TrimSpace(part[idx+1:])
+			if strings.HasPrefix(param, "q=") {
+				v, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				if err != nil {
+					continue
+				}
+				q = v
+			}
+		}
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if len(coding) == 0 {
+			continue
+		}
+		if _, ok := accepted[coding]; !ok || q <= 0 {
+			// An explicit q=0 wins over the wildcard and duplicates.
+			accepted[coding] = q > 0
+		}
+	}
+	for _, coding := range supportedEncodings {
+		if ok, found := accepted[coding]; found {
+			if ok {
+				return coding
+			}
+			continue
+		}
+		if accepted["*"] {
+			return coding
+		}
+	}
+	return ""
+}
+
+// compressResponse negotiates the content coding with the client, and returns the writer for the body.
+// The returned function must be called to flush the compressed body after it has been written.
+func compressResponse(w http.ResponseWriter, r *http.Request) (io.Writer, func() error) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	switch negotiateEncoding(r.Header.Get("Accept-Encoding")) {
+	case "zstd":
+		enc, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return w, func() error { return nil }
+		}
+		w.Header().Set("Content-Encoding", "zstd")
+		return enc, enc.Close
+	case "gzip":
+		gz := gzip.NewWriter(w)
+		w.Header().Set("Content-Encoding", "gzip")
+		return gz, gz.Close
+	default:
+		return w, func() error { return nil }
+	}
+}
+
+// minZstdDecoderMemory keeps the window of usual zstd encoders (8MiB) decodable, even with a small body_size_limit.
+const minZstdDecoderMemory = 8 << 20
+
+// decodeBody returns the body of the response decompressed by its Content-Encoding.
+// limit is body_size_limit of the target, which bounds the window of zstd. limit <= 0 means no limit.
+func decodeBody(resp *http.Response, limit ByteSize) (io.ReadCloser, error) {
+	switch encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return resp.Body, nil
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		return gz, nil
+	case "zstd":
+		options := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+		if limit > 0 {
+			// A frame can ask for a window as large as 1GiB, which is allocated before anything is written.
+			memory := uint64(limit)
+			if memory < minZstdDecoderMemory {
+				memory = minZstdDecoderMemory
+			}
+			options = append(options, zstd.WithDecoderMaxMemory(memory))
+		}
+		dec, err := zstd.NewReader(resp.Body, options...)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding: %s", encoding)
+	}
+}
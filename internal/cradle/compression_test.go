@@ -0,0 +1,140 @@
+package cradle
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := []struct {
+		header   string
+		expected string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br, zstd", "zstd"},
+		{"zstd;q=0, gzip;q=0.5", "gzip"},
+		{"GZIP;q=1.0", "gzip"},
+		{"*", "zstd"},
+		{"*, zstd;q=0", "gzip"},
+		{"gzip;q=0", ""},
+	}
+	for _, c := range cases {
+		if actual := negotiateEncoding(c.header); actual != c.expected {
+			t.Errorf("Unexpected encoding for %q: %q, expected %q", c.header, actual, c.expected)
+		}
+	}
+}
+
+func TestCompressResponse(t *testing.T) {
+	const body = "up 1\n"
+	for _, encoding := range []string{"", "gzip", "zstd"} {
+		req := httptest.NewRequest("GET", "/probe", nil)
+		if len(encoding) > 0 {
+			req.Header.Set("Accept-Encoding", encoding)
+		}
+		rec := httptest.NewRecorder()
+		out, closeOut := compressResponse(rec, req)
+		_, _ = out.Write([]byte(body))
+		if err := closeOut(); err != nil {
+			t.Fatal(err)
+		}
+		if actual := rec.Header().Get("Content-Encoding"); actual != encoding {
+			t.Errorf("Unexpected Content-Encoding: %q, expected %q", actual, encoding)
+		}
+		decoded, err := decodeBody(rec.Result(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := ioutil.ReadAll(decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(actual) != body {
+			t.Errorf("Unexpected body with %q: %q", encoding, actual)
+		}
+	}
+}
+
+func TestScrapeCompressedEndpoint(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buff bytes.Buffer
+		switch r.URL.Path {
+		case "/gzip":
+			gz := gzip.NewWriter(&buff)
+			_, _ = gz.Write([]byte("up{encoding=\"gzip\"} 1\n"))
+			_ = gz.Close()
+			w.Header().Set("Content-Encoding", "gzip")
+		case "/zstd":
+			enc, _ := zstd.NewWriter(&buff)
+			_, _ = enc.Write([]byte("up{encoding=\"zstd\"} 1\n"))
+			_ = enc.Close()
+			w.Header().Set("Content-Encoding", "zstd")
+		default:
+			w.Header().Set("Content-Encoding", "br")
+			buff.WriteString("garbage")
+		}
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			t.Errorf("Unexpected Accept-Encoding: %s", r.Header.Get("Accept-Encoding"))
+		}
+		_, _ = buff.WriteTo(w)
+	}))
+	defer server.Close()
+	for _, encoding := range []string{"gzip", "zstd"} {
+		var buff bytes.Buffer
+		if err := scrapeEndpoint(context.Background(), &buff, "target", nil, server.URL+"/"+encoding); err != nil {
+			t.Fatalf("Failed to scrape: %v", err)
+		}
+		if !strings.Contains(buff.String(), `up{encoding="`+encoding+`"} 1`) {
+			t.Errorf("Unexpected output: %s", buff.String())
+		}
+	}
+	var buff bytes.Buffer
+	if err := scrapeEndpoint(context.Background(), &buff, "target", nil, server.URL+"/br"); err == nil {
+		t.Errorf("Unsupported encoding must be an error: %s", buff.String())
+	}
+}
+
+func TestDecodeZstdWindowLimit(t *testing.T) {
+	// A stream asking for a 64MiB window. It is larger than a block, so the window is in the frame header.
+	content := strings.Repeat("up 1\n", 1<<18)
+	var buff bytes.Buffer
+	enc, err := zstd.NewWriter(&buff, zstd.WithWindowSize(64<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = enc.Write([]byte(content))
+	_ = enc.Close()
+	decode := func(limit ByteSize) ([]byte, error) {
+		resp := &http.Response{
+			Header: http.Header{"Content-Encoding": {"zstd"}},
+			Body:   ioutil.NopCloser(bytes.NewReader(buff.Bytes())),
+		}
+		body, err := decodeBody(resp, limit)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = body.Close()
+		}()
+		return ioutil.ReadAll(body)
+	}
+	if _, err := decode(1 << 20); err == nil {
+		t.Error("Window larger than the limit must be rejected")
+	}
+	if out, err := decode(128 << 20); err != nil || string(out) != content {
+		t.Errorf("Window within the limit must be decoded: %d bytes, %v", len(out), err)
+	}
+	if out, err := decode(0); err != nil || string(out) != content {
+		t.Errorf("Window must not be limited without the limit: %d bytes, %v", len(out), err)
+	}
+}
@@ -1,33 +1,211 @@
 package cradle
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
+	"go.uber.org/zap"
 	"gopkg.in/yaml.v2"
 )
 
 type ExporterConfig struct {
-	Endpoints []string `yaml:"endpoints,omitempty"`
+	Endpoints  []string          `yaml:"endpoints,omitempty"`
+	HTTPClient *HTTPClientConfig `yaml:"http_client,omitempty"`
 }
 
-type ScriptConfig struct {
+// HTTPClientConfig tells how to scrape endpoints of exporter and service targets.
+type HTTPClientConfig struct {
+	TLS       TLSConfig        `yaml:"tls_config,omitempty"`
+	BasicAuth *BasicAuthConfig `yaml:"basic_auth,omitempty"`
+	// BearerTokenFile is read every request, to send its content as a bearer token.
+	BearerTokenFile string `yaml:"bearer_token_file,omitempty"`
+	// Headers are added to every request.
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// ProxyURL is the proxy to send requests through. Defaults to HTTP_PROXY and related env vars.
+	ProxyURL string `yaml:"proxy_url,omitempty"`
+	// Timeouts of the transport. Zero means the defaults of Go, or no timeout.
+	DialTimeout           time.Duration `yaml:"dial_timeout,omitempty"`
+	TLSHandshakeTimeout   time.Duration `yaml:"tls_handshake_timeout,omitempty"`
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout,omitempty"`
+	// MaxIdleConns is the number of idle (keep-alive) connections kept per host.
+	MaxIdleConns int `yaml:"max_idle_conns,omitempty"`
+	// EnableHTTP2 tells whether to use HTTP/2 over TLS. Defaults to true.
+	EnableHTTP2 *bool `yaml:"enable_http2,omitempty"`
+}
+
+type TLSConfig struct {
+	CAFile string `yaml:"ca_file,omitempty"`
+	// CertFile and KeyFile are the client certificate, for mutual TLS.
+	CertFile           string `yaml:"cert_file,omitempty"`
+	KeyFile            string `yaml:"key_file,omitempty"`
+	ServerName         string `yaml:"server_name,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"`
+}
+
+type BasicAuthConfig struct {
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	// PasswordFile is read every request, instead of Password.
+	PasswordFile string `yaml:"password_file,omitempty"`
+}
+
+// ProcessConfig is the common config of targets which launch a process.
+type ProcessConfig struct {
 	Path string   `yaml:"path,omitempty"`
 	Args []string `yaml:"args,omitempty"`
+	// Env is added to the environment, after the variables in EnvFile.
+	Env     map[string]string `yaml:"env,omitempty"`
+	EnvFile string            `yaml:"env_file,omitempty"`
+	// InheritEnv tells whether the process inherits the environment of cradle. Defaults to true.
+	InheritEnv *bool  `yaml:"inherit_env,omitempty"`
+	WorkDir    string `yaml:"workdir,omitempty"`
+	// Stdin is given to the standard input of the process. Empty if not set.
+	Stdin *string `yaml:"stdin,omitempty"`
+	// User and Group to launch the process as. Names or numeric ids.
+	// Group defaults to the primary group of User.
+	User  string `yaml:"user,omitempty"`
+	Group string `yaml:"group,omitempty"`
+	// Groups are the supplementary groups. Defaults to the groups User belongs to.
+	Groups []string `yaml:"groups,omitempty"`
+	// Nice is the niceness of the process, from -20 (highest priority) to 19.
+	Nice   *int         `yaml:"nice,omitempty"`
+	Limits LimitsConfig `yaml:"limits,omitempty"`
+}
+
+// LimitsConfig is the resource limits (rlimits) of a launched process. Zero means not limited.
+type LimitsConfig struct {
+	// CPU time in seconds.
+	CPU uint64 `yaml:"cpu,omitempty"`
+	// AddressSpace is the size of virtual memory in bytes.
+	AddressSpace uint64 `yaml:"as,omitempty"`
+	// NoFile is the number of open files.
+	NoFile uint64 `yaml:"nofile,omitempty"`
+	// NProc is the number of processes, counted per user, not per target.
+	NProc uint64 `yaml:"nproc,omitempty"`
+}
+
+type ScriptConfig struct {
+	ProcessConfig `yaml:",inline"`
 }
 
 type ServiceConfig struct {
-	Path      string   `yaml:"path,omitempty"`
-	Args      []string `yaml:"args,omitempty"`
-	Endpoints []string `yaml:"endpoints,omitempty"`
+	ProcessConfig `yaml:",inline"`
+	Endpoints     []string          `yaml:"endpoints,omitempty"`
+	HTTPClient    *HTTPClientConfig `yaml:"http_client,omitempty"`
+	// Port is "auto" to pick a free port on localhost, or a port number.
+	// If set, "{{ .Port }}" in args, env, endpoints and health checks is replaced with it.
+	Port    string        `yaml:"port,omitempty"`
+	Restart RestartConfig `yaml:"restart,omitempty"`
+	// Readiness tells when the daemon is ready to be scraped after it started.
+	Readiness *HealthCheckConfig `yaml:"readiness,omitempty"`
+	// Liveness tells whether the running daemon still works. If not, it is killed and restarted.
+	// Defaults to GET the first endpoint every 10s.
+	Liveness *HealthCheckConfig `yaml:"liveness,omitempty"`
+	// LogLines is how many lines of stdout and stderr each to keep. Defaults to 1000.
+	LogLines int `yaml:"log_lines,omitempty"`
+	// StopSignal is sent to stop the daemon. Defaults to SIGTERM.
+	StopSignal string `yaml:"stop_signal,omitempty"`
+	// StopTimeout is how long to wait for the daemon to exit after StopSignal before killing it.
+	StopTimeout time.Duration `yaml:"stop_timeout,omitempty"`
+}
+
+const defaultStopTimeout = 10 * time.Second
+
+// HealthCheckConfig tells how to check a daemon. Exactly one of HTTP, TCP and Command must be set.
+type HealthCheckConfig struct {
+	// HTTP is the URL to GET. Healthy if it returns 2xx.
+	HTTP string `yaml:"http,omitempty"`
+	// TCP is the address to connect. Healthy if connected.
+	TCP string `yaml:"tcp,omitempty"`
+	// Command is the command line to run with the same environment as the daemon. Healthy if it exits with 0.
+	Command  []string      `yaml:"command,omitempty"`
+	Interval time.Duration `yaml:"interval,omitempty"`
+	Timeout  time.Duration `yaml:"timeout,omitempty"`
+	// FailureThreshold is how many failures in a row make a liveness check fail. Not used by readiness.
+	FailureThreshold int `yaml:"failure_threshold,omitempty"`
+}
+
+func (cfg HealthCheckConfig) withDefaults() HealthCheckConfig {
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Second
+	}
+	if cfg.FailureThreshold <= 0 {
+		cfg.FailureThreshold = 3
+	}
+	return cfg
+}
+
+// RestartConfig controls how a dead daemon is restarted.
+// Zero values are replaced with defaults by withDefaults.
+type RestartConfig struct {
+	InitialBackoff time.Duration `yaml:"initial_backoff,omitempty"`
+	MaxBackoff     time.Duration `yaml:"max_backoff,omitempty"`
+	Multiplier     float64       `yaml:"multiplier,omitempty"`
+	// Jitter is nil for the default, so that 0 can turn it off.
+	Jitter *float64 `yaml:"jitter,omitempty"`
+	// The daemon is marked as failed and not restarted any more,
+	// when it restarts more than MaxRestarts times within Window. 0 means unlimited.
+	MaxRestarts int           `yaml:"max_restarts,omitempty"`
+	Window      time.Duration `yaml:"window,omitempty"`
+}
+
+const (
+	defaultRestartInitialBackoff = time.Second
+	defaultRestartMaxBackoff     = time.Minute
+	defaultRestartMultiplier     = 2.0
+	defaultRestartJitter         = 0.2
+	defaultRestartWindow         = 10 * time.Minute
+)
+
+func (cfg RestartConfig) withDefaults() RestartConfig {
+	if cfg.InitialBackoff <= 0 {
+		cfg.InitialBackoff = defaultRestartInitialBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = defaultRestartMaxBackoff
+	}
+	if cfg.MaxBackoff < cfg.InitialBackoff {
+		cfg.MaxBackoff = cfg.InitialBackoff
+	}
+	if cfg.Multiplier < 1 {
+		cfg.Multiplier = defaultRestartMultiplier
+	}
+	if cfg.Jitter == nil || *cfg.Jitter < 0 || 1 < *cfg.Jitter {
+		jitter := defaultRestartJitter
+		cfg.Jitter = &jitter
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = defaultRestartWindow
+	}
+	return cfg
+}
+
+// backoff returns how long to wait before the given attempt (starting from 0) of restarting.
+func (cfg RestartConfig) backoff(attempt int) time.Duration {
+	backoff := float64(cfg.InitialBackoff) * math.Pow(cfg.Multiplier, float64(attempt))
+	if backoff > float64(cfg.MaxBackoff) {
+		backoff = float64(cfg.MaxBackoff)
+	}
+	backoff *= 1 + *cfg.Jitter*(2*rand.Float64()-1)
+	return time.Duration(backoff)
 }
 
 type CronJobConfig struct {
-	Path  string   `yaml:"path,omitempty"`
-	Args  []string `yaml:"args,omitempty"`
-	Every string   `yaml:"every,omitempty"`
+	ProcessConfig `yaml:",inline"`
+	Every         string `yaml:"every,omitempty"`
 }
 
 type StaticFileConfig struct {
@@ -36,11 +214,68 @@ type StaticFileConfig struct {
 
 type TargetConfig struct {
 	ConfigFilePath string            `yaml:",omitempty"`
+	Name           string            `yaml:"name,omitempty"`
+	Labels         map[string]string `yaml:"labels,omitempty"`
+	HonorLabels    bool              `yaml:"honor_labels,omitempty"`
+	Timeout        time.Duration     `yaml:"timeout,omitempty"`
+	// BodySizeLimit is the max size of the output of the target. Defaults to probe.body_size_limit.
+	BodySizeLimit  ByteSize          `yaml:"body_size_limit,omitempty"`
 	ExporterConfig *ExporterConfig   `yaml:"exporter,omitempty"`
 	ServiceConfig  *ServiceConfig    `yaml:"service,omitempty"`
 	ScriptConfig   *ScriptConfig     `yaml:"script,omitempty"`
 	CronJobConfig  *CronJobConfig    `yaml:"cron,omitempty"`
 	StaticConfig   *StaticFileConfig `yaml:"static,omitempty"`
+	// fileDigests are the contents of the files read only when the target is made or its process starts,
+	// so that changing them also makes the target changed on reload.
+	fileDigests map[string][sha256.Size]byte
+}
+
+// filesReadOnce returns the files the target reads only when it is made or its process starts.
+// The password and bearer token files and the client certificate are not, since they are read every request.
+func (cfg *TargetConfig) filesReadOnce() []string {
+	paths := make([]string, 0)
+	processes := make([]*ProcessConfig, 0, 1)
+	clients := make([]*HTTPClientConfig, 0, 1)
+	if cfg.ScriptConfig != nil {
+		processes = append(processes, &cfg.ScriptConfig.ProcessConfig)
+	}
+	if cfg.CronJobConfig != nil {
+		processes = append(processes, &cfg.CronJobConfig.ProcessConfig)
+	}
+	if cfg.ServiceConfig != nil {
+		processes = append(processes, &cfg.ServiceConfig.ProcessConfig)
+		clients = append(clients, cfg.ServiceConfig.HTTPClient)
+	}
+	if cfg.ExporterConfig != nil {
+		clients = append(clients, cfg.ExporterConfig.HTTPClient)
+	}
+	for _, process := range processes {
+		if len(process.EnvFile) > 0 {
+			paths = append(paths, process.EnvFile)
+		}
+	}
+	for _, client := range clients {
+		if client != nil && len(client.TLS.CAFile) > 0 {
+			paths = append(paths, client.TLS.CAFile)
+		}
+	}
+	return paths
+}
+
+// TargetLabelName is the label added to every sample to tell which target it came from.
+const TargetLabelName = "cradle_target"
+
+// Target names are used in URL paths, so they are restricted.
+var validTargetName = regexp.MustCompile(`^[a-zA-Z0-9_.:-]+$`)
+
+// TargetLabels returns the labels to be added to every sample of the target.
+func (cfg *TargetConfig) TargetLabels() map[string]string {
+	labels := make(map[string]string, len(cfg.Labels)+1)
+	labels[TargetLabelName] = cfg.Name
+	for name, value := range cfg.Labels {
+		labels[name] = value
+	}
+	return labels
 }
 
 type CliConfig struct {
@@ -54,35 +289,195 @@ type WebConfig struct {
 	ProbePath         string `yaml:"probe_path,omitempty"`
 	MetricPath        string `yaml:"metric_path,omitempty"`
 	ListenAddress     string `yaml:"listen_address,omitempty"`
+	// EnableDaemonLogs serves what daemons wrote at /targets/{name}/logs. They may contain secrets, so it is opt-in.
+	EnableDaemonLogs bool `yaml:"enable_daemon_logs,omitempty"`
+}
+
+type ProbeConfig struct {
+	MaxConcurrency int           `yaml:"max_concurrency,omitempty"`
+	Timeout        time.Duration `yaml:"timeout,omitempty"`
+	TimeoutOffset  time.Duration `yaml:"timeout_offset,omitempty"`
+	// BodySizeLimit is the default of body_size_limit of targets. Zero means no limit.
+	BodySizeLimit ByteSize `yaml:"body_size_limit,omitempty"`
+}
+
+// ByteSize is a size in bytes, written as a number or with a unit like "10MiB".
+// Units are in powers of 1024, whether they are written as "KB" or "KiB".
+type ByteSize int64
+
+var byteSizeUnits = map[string]ByteSize{
+	"":    1,
+	"B":   1,
+	"K":   1 << 10,
+	"KB":  1 << 10,
+	"KIB": 1 << 10,
+	"M":   1 << 20,
+	"MB":  1 << 20,
+	"MIB": 1 << 20,
+	"G":   1 << 30,
+	"GB":  1 << 30,
+	"GIB": 1 << 30,
+}
+
+var byteSizePattern = regexp.MustCompile(`^\s*([0-9]+)\s*([a-zA-Z]*)\s*$`)
+
+func (size *ByteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var text string
+	if err := unmarshal(&text); err != nil {
+		return err
+	}
+	match := byteSizePattern.FindStringSubmatch(text)
+	if match == nil {
+		return fmt.Errorf("invalid size: %q", text)
+	}
+	unit, ok := byteSizeUnits[strings.ToUpper(match[2])]
+	if !ok {
+		return fmt.Errorf("invalid unit of size: %q", text)
+	}
+	value, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size: %q", text)
+	}
+	if value > math.MaxInt64/int64(unit) {
+		return fmt.Errorf("size too large: %q", text)
+	}
+	*size = ByteSize(value) * unit
+	return nil
 }
 
 type Config struct {
-	IncludeDirs []string  `yaml:"include_dirs,omitempty"`
-	Cli         CliConfig `yaml:"cli,omitempty"`
-	Web         WebConfig `yaml:"web,omitempty"`
+	IncludeDirs   []string      `yaml:"include_dirs,omitempty"`
+	Watch         bool          `yaml:"watch,omitempty"`
+	WatchDebounce time.Duration `yaml:"watch_debounce,omitempty"`
+	Cli           CliConfig     `yaml:"cli,omitempty"`
+	Web           WebConfig     `yaml:"web,omitempty"`
+	Probe         ProbeConfig   `yaml:"probe,omitempty"`
 }
 
-func ReadTargetConfigFromFile(path string) (*TargetConfig, error) {
+const (
+	defaultProbeMaxConcurrency = 16
+	defaultProbeTimeout        = 10 * time.Second
+	defaultProbeTimeoutOffset  = 500 * time.Millisecond
+	defaultWatchDebounce       = time.Second
+)
+
+// ReadTargetConfigsFromFile reads all the targets in a file.
+// Targets without a name are named after the file; "<basename>-<index>" if the file has more than one target.
+func ReadTargetConfigsFromFile(path string) ([]*TargetConfig, error) {
 	bytes, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	config, err := ReadTargetConfig(bytes)
-	if config != nil {
+	configs, err := ReadTargetConfigs(bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for idx, config := range configs {
 		config.ConfigFilePath = path
+		if len(config.Name) > 0 {
+			continue
+		}
+		if len(configs) == 1 {
+			config.Name = targetNameFromPath(path)
+		} else {
+			config.Name = fmt.Sprintf("%s-%d", targetNameFromPath(path), idx+1)
+		}
 	}
-	return config, err
+	return configs, nil
 }
 
+// targetNameFromPath makes a target name from the base name of its config file, without the extension.
+func targetNameFromPath(path string) string {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// ReadTargetConfig reads a config which must contain exactly one target.
 func ReadTargetConfig(bytes []byte) (*TargetConfig, error) {
-	var err error
-	var config TargetConfig
-	config.ConfigFilePath = "<mem>"
-	err = yaml.UnmarshalStrict(bytes, &config)
+	configs, err := ReadTargetConfigs(bytes)
 	if err != nil {
 		return nil, err
 	}
-	return &config, nil
+	if len(configs) != 1 {
+		return nil, fmt.Errorf("config must contain exactly one target, but contains %d", len(configs))
+	}
+	return configs[0], nil
+}
+
+// ReadTargetConfigs reads targets from a config.
+// Each YAML document can be either a target or a list of targets.
+func ReadTargetConfigs(bytes []byte) ([]*TargetConfig, error) {
+	configs := make([]*TargetConfig, 0, 1)
+	decoder := yaml.NewDecoder(strings.NewReader(string(bytes)))
+	decoder.SetStrict(true)
+	for {
+		var doc targetConfigDocument
+		err := decoder.Decode(&doc)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, config := range doc {
+			if config == nil {
+				return nil, fmt.Errorf("target #%d: empty target", len(configs)+1)
+			}
+			config.ConfigFilePath = "<mem>"
+			if err := config.validateType(); err != nil {
+				return nil, fmt.Errorf("target #%d: %v", len(configs)+1, err)
+			}
+			configs = append(configs, config)
+		}
+	}
+	return configs, nil
+}
+
+// targetConfigDocument is a YAML document of a target config file; either a target or a list of targets.
+// It is decoded straight from the file, so that errors tell lines of the file.
+type targetConfigDocument []*TargetConfig
+
+func (doc *targetConfigDocument) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// Only a list of mappings can be decoded into []yaml.MapSlice; no key is checked by it.
+	var items []yaml.MapSlice
+	if err := unmarshal(&items); err == nil {
+		var configs []*TargetConfig
+		if err := unmarshal(&configs); err != nil {
+			return err
+		}
+		*doc = configs
+		return nil
+	}
+	var config TargetConfig
+	if err := unmarshal(&config); err != nil {
+		return err
+	}
+	*doc = targetConfigDocument{&config}
+	return nil
+}
+
+// validateType checks that the target sets at most one of the target types.
+func (cfg *TargetConfig) validateType() error {
+	types := make([]string, 0, 1)
+	if cfg.ExporterConfig != nil {
+		types = append(types, "exporter")
+	}
+	if cfg.ServiceConfig != nil {
+		types = append(types, "service")
+	}
+	if cfg.ScriptConfig != nil {
+		types = append(types, "script")
+	}
+	if cfg.CronJobConfig != nil {
+		types = append(types, "cron")
+	}
+	if cfg.StaticConfig != nil {
+		types = append(types, "static")
+	}
+	if len(types) > 1 {
+		return fmt.Errorf("target must set only one of exporter/service/script/cron/static, but sets %s", strings.Join(types, ", "))
+	}
+	return nil
 }
 
 func ReadConfigFromFile(path string) (*Config, error) {
@@ -100,9 +495,23 @@ func ReadConfig(bytes []byte) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	if config.Probe.MaxConcurrency <= 0 {
+		config.Probe.MaxConcurrency = defaultProbeMaxConcurrency
+	}
+	if config.Probe.Timeout <= 0 {
+		config.Probe.Timeout = defaultProbeTimeout
+	}
+	if config.Probe.TimeoutOffset <= 0 {
+		config.Probe.TimeoutOffset = defaultProbeTimeoutOffset
+	}
+	if config.WatchDebounce <= 0 {
+		config.WatchDebounce = defaultWatchDebounce
+	}
 	return &config, nil
 }
 
+// collectTargetConfigsFromDir reads all the target configs in the dir, keyed by target name.
+// Target names must be unique across all the dirs.
 func collectTargetConfigsFromDir(dpath string, dst map[string]*TargetConfig) error {
 	dpath = filepath.Clean(dpath)
 	info, err := os.Lstat(dpath)
@@ -138,11 +547,22 @@ func collectTargetConfigsFromDir(dpath string, dst map[string]*TargetConfig) err
 				return err
 			}
 		}
-		config, err := ReadTargetConfigFromFile(fpath)
+		configs, err := ReadTargetConfigsFromFile(fpath)
 		if err != nil {
 			return err
 		}
-		dst[fpath] = config
+		if len(configs) == 0 {
+			zap.L().Warn("Config file has no targets", zap.String("path", fpath))
+		}
+		for _, config := range configs {
+			if !validTargetName.MatchString(config.Name) {
+				return fmt.Errorf("invalid target name in %s: %q", fpath, config.Name)
+			}
+			if other, ok := dst[config.Name]; ok {
+				return fmt.Errorf("duplicate target name %q: %s and %s", config.Name, other.ConfigFilePath, fpath)
+			}
+			dst[config.Name] = config
+		}
 		return nil
 	})
 }
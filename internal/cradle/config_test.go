@@ -1,8 +1,18 @@
 package cradle
 
 import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing" // テストで使える関数・構造体が用意されているパッケージをimport
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"gopkg.in/yaml.v2"
 )
 
 func TestReadExporterConfig(t *testing.T) {
@@ -69,3 +79,260 @@ script:
 		t.Error("Config should not include exporter config")
 	}
 }
+
+func TestCollectTargetConfigsName(t *testing.T) {
+	dir1 := t.TempDir()
+	dir2 := t.TempDir()
+	writeFile := func(path string, content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+	}
+	writeFile(filepath.Join(dir1, "node.yml"), "script: {path: /usr/bin/script}\n")
+	writeFile(filepath.Join(dir1, "other.yml"), "name: mysql\nexporter: {endpoints: ['http://localhost:9104/metrics']}\n")
+	configs := make(map[string]*TargetConfig)
+	if err := collectTargetConfigsFromDir(dir1, configs); err != nil {
+		t.Fatalf("Failed to collect configs: %v", err)
+	}
+	if _, ok := configs["node"]; !ok {
+		t.Errorf("Target name must fall back to the file basename: %v", configs)
+	}
+	if _, ok := configs["mysql"]; !ok {
+		t.Errorf("Target name must be taken from config: %v", configs)
+	}
+	writeFile(filepath.Join(dir2, "mysql.yml"), "exporter: {endpoints: ['http://localhost:9105/metrics']}\n")
+	if err := collectTargetConfigsFromDir(dir2, configs); err == nil {
+		t.Error("Duplicate target names across dirs must be rejected")
+	}
+}
+
+func TestCollectTargetConfigsFromEmptyFile(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{"empty.yml": "", "comment.yml": "# disabled\n---\n"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+	}
+	core, logs := observer.New(zap.WarnLevel)
+	defer zap.ReplaceGlobals(zap.New(core))()
+	configs := make(map[string]*TargetConfig)
+	if err := collectTargetConfigsFromDir(dir, configs); err != nil {
+		t.Fatalf("Failed to collect configs: %v", err)
+	}
+	if len(configs) != 0 {
+		t.Errorf("Empty files must not have targets: %v", configs)
+	}
+	if n := logs.FilterMessage("Config file has no targets").Len(); n != 2 {
+		t.Errorf("Empty files must be warned: %d warnings", n)
+	}
+}
+
+func TestReadMultipleTargetConfigs(t *testing.T) {
+	const kDocuments = `
+---
+name: node
+script:
+  path: /usr/bin/node.sh
+---
+exporter:
+  endpoints:
+    - "http://localhost:9100/metrics"
+`
+	confs, err := ReadTargetConfigs([]byte(kDocuments))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if len(confs) != 2 {
+		t.Fatalf("Number of targets does not match: %d != 2", len(confs))
+	}
+	if confs[0].Name != "node" || confs[0].ScriptConfig == nil {
+		t.Errorf("First target does not match: %v", confs[0])
+	}
+	if confs[1].ExporterConfig == nil {
+		t.Errorf("Second target does not match: %v", confs[1])
+	}
+
+	const kList = `
+---
+- name: node
+  script:
+    path: /usr/bin/node.sh
+- name: mysql
+  exporter:
+    endpoints:
+      - "http://localhost:9104/metrics"
+`
+	confs, err = ReadTargetConfigs([]byte(kList))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if len(confs) != 2 {
+		t.Fatalf("Number of targets does not match: %d != 2", len(confs))
+	}
+	if confs[1].Name != "mysql" || confs[1].ExporterConfig == nil {
+		t.Errorf("Second target does not match: %v", confs[1])
+	}
+}
+
+func TestReadTargetConfigsErrors(t *testing.T) {
+	cases := []struct {
+		config string
+		err    string
+	}{
+		{"name: a\nname: b\nscript: {path: /bin/true}\n", "line 2: field name already set"},
+		{"- name: a\n  script: {path: /bin/true}\n- name: b\n  name: c\n", "line 4: field name already set"},
+		{"---\nname: a\n---\nname: b\nscript:\n  path: /bin/true\n  unknown: 1\n", "line 7: field unknown not found"},
+		{"- name: a\n  unknown: 1\n", "line 2: field unknown not found"},
+		{"script\n", "cannot unmarshal"},
+		{"- \n", "empty target"},
+	}
+	for _, c := range cases {
+		_, err := ReadTargetConfigs([]byte(c.config))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("Error must contain %q: %v\n%s", c.err, err, c.config)
+		}
+	}
+}
+
+func TestReadTargetConfigWithMultipleTypes(t *testing.T) {
+	const kConfigString = `
+---
+script:
+  path: /usr/bin/script
+exporter:
+  endpoints:
+    - "https://example.com/"
+`
+	if _, err := ReadTargetConfig([]byte(kConfigString)); err == nil {
+		t.Error("Target with multiple types must be rejected")
+	}
+}
+
+func TestRestartBackoff(t *testing.T) {
+	jitter := 0.1
+	cfg := RestartConfig{
+		InitialBackoff: time.Second,
+		MaxBackoff:     10 * time.Second,
+		Multiplier:     2,
+		Jitter:         &jitter,
+	}.withDefaults()
+	cases := []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{3, 8 * time.Second},
+		{10, 10 * time.Second},
+	}
+	for _, c := range cases {
+		backoff := cfg.backoff(c.attempt)
+		min := time.Duration(float64(c.expected) * 0.9)
+		max := time.Duration(float64(c.expected) * 1.1)
+		if backoff < min || max < backoff {
+			t.Errorf("Backoff out of range: attempt=%d, %v not in [%v, %v]", c.attempt, backoff, min, max)
+		}
+	}
+
+	var restart RestartConfig
+	if err := yaml.Unmarshal([]byte("jitter: 0\n"), &restart); err != nil {
+		t.Fatal(err)
+	}
+	if backoff := restart.withDefaults().backoff(1); backoff != 2*time.Second {
+		t.Errorf("Jitter 0 must turn it off: %v", backoff)
+	}
+	restart = RestartConfig{}
+	if jitter := *restart.withDefaults().Jitter; jitter != defaultRestartJitter {
+		t.Errorf("Jitter must default to %v: %v", defaultRestartJitter, jitter)
+	}
+}
+
+func TestServicePort(t *testing.T) {
+	conf, err := ReadTargetConfig([]byte(`
+service:
+  path: /usr/bin/exporter
+  args: ['--web.listen-address=127.0.0.1:{{ .Port }}']
+  env:
+    PORT: '{{ .Port }}'
+  endpoints: ['http://127.0.0.1:{{ .Port }}/metrics']
+  port: 9100
+`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	port, err := conf.ServiceConfig.allocatePort(false)
+	if err != nil || port != 9100 {
+		t.Fatalf("Unexpected port: %d, %v", port, err)
+	}
+	service, err := conf.ServiceConfig.withPort(port)
+	if err != nil {
+		t.Fatalf("Failed to set port: %v", err)
+	}
+	if service.Args[0] != "--web.listen-address=127.0.0.1:9100" || service.Env["PORT"] != "9100" || service.Endpoints[0] != "http://127.0.0.1:9100/metrics" {
+		t.Errorf("Port not substituted: %+v", service)
+	}
+	if conf.ServiceConfig.Args[0] != "--web.listen-address=127.0.0.1:{{ .Port }}" {
+		t.Errorf("Original config modified: %v", conf.ServiceConfig.Args)
+	}
+
+	// Other template actions are not evaluated.
+	conf.ServiceConfig.Args = []string{`--format={{.Name}}`, `--listen={{ .Port }},{{.Port}}`}
+	if service, err := conf.ServiceConfig.withPort(port); err != nil || service.Args[0] != `--format={{.Name}}` || service.Args[1] != "--listen=9100,9100" {
+		t.Errorf("Only the port must be replaced: %v", err)
+	}
+	// Other spellings of the port must not be passed to the daemon.
+	for _, arg := range []string{`{{- .Port }}`, `{{ .Port | printf "%d" }}`, `{{ .Port -}}`} {
+		conf.ServiceConfig.Args = []string{arg}
+		if _, err := conf.ServiceConfig.withPort(port); err == nil {
+			t.Errorf("Unknown placeholder must be rejected: %s", arg)
+		}
+	}
+
+	conf.ServiceConfig.Port = "auto"
+	port, err = conf.ServiceConfig.allocatePort(false)
+	if err != nil || port <= 0 {
+		t.Fatalf("Unexpected auto port: %d, %v", port, err)
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Errorf("Auto port must be free: %v", err)
+	} else {
+		_ = listener.Close()
+	}
+	if port, err := conf.ServiceConfig.allocatePort(true); err != nil || port != 0 {
+		t.Errorf("No port must be allocated for checking: %d, %v", port, err)
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	cases := map[string]ByteSize{
+		"1024":   1024,
+		"10KiB":  10 * 1024,
+		"10 MB":  10 * 1024 * 1024,
+		"1g":     1024 * 1024 * 1024,
+		"0":      0,
+		"100 B":  100,
+		"5 MiB ": 5 * 1024 * 1024,
+	}
+	for text, expected := range cases {
+		var size ByteSize
+		if err := yaml.Unmarshal([]byte("'"+text+"'"), &size); err != nil || size != expected {
+			t.Errorf("Unexpected size of %q: %d, %v", text, size, err)
+		}
+	}
+	var size ByteSize
+	if err := yaml.Unmarshal([]byte("10XB"), &size); err == nil {
+		t.Error("Unknown unit must be rejected")
+	}
+	for _, text := range []string{"99999999999G", "8589934592G", "99999999999999999999"} {
+		if err := yaml.Unmarshal([]byte(text), &size); err == nil {
+			t.Errorf("Overflowing size must be rejected: %s, %d", text, size)
+		}
+	}
+	if err := yaml.Unmarshal([]byte("8589934591G"), &size); err != nil || size != 8589934591<<30 {
+		t.Errorf("Largest size must be accepted: %d, %v", size, err)
+	}
+	if err := yaml.Unmarshal([]byte("4096"), &size); err != nil || size != 4096 {
+		t.Errorf("Unexpected size of number: %d, %v", size, err)
+	}
+}
@@ -10,27 +10,40 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"path"
 	"reflect"
 	"strings"
 	"sync"
 	"text/template"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/robfig/cron"
 	"go.uber.org/atomic"
 	"go.uber.org/zap"
 )
 
 type Target interface {
-	Scrape(ctx context.Context, w io.Writer)
+	Scrape(ctx context.Context, w io.Writer) error
+	Name() string
 	ConfigFilePath() string
+	TargetConfig() *TargetConfig
 }
 
 type Cradle struct {
 	configValue  atomic.Value
 	targetsValue atomic.Value
 	haltedValue  atomic.Bool
+	haltOnce     sync.Once
+	haltCh       chan struct{}
+	// reloading serializes reloads, so that the targets and the jobs of the runner are from the same one.
+	reloading sync.Mutex
+	// target name -> unix time of the last scrape error
+	lastErrorTimestamps sync.Map
+	//
+	registry *prometheus.Registry
+	metrics  *collector
 	//
 	serverValue atomic.Value
 	runnerValue atomic.Value
@@ -41,36 +54,61 @@ func New(config *Config) *Cradle {
 		configValue:  atomic.Value{},
 		targetsValue: atomic.Value{},
 		haltedValue:  atomic.Bool{},
+		haltCh:       make(chan struct{}),
 		//
 		serverValue: atomic.Value{},
+		registry:    prometheus.NewRegistry(),
 	}
 	cradle.configValue.Store(config)
+	cradle.metrics = newCollector(cradle)
+	cradle.runnerValue.Store(newRunner(cradle.metrics))
+	cradle.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		cradle.metrics,
+	)
 	return cradle
 }
 
 func (cradle *Cradle) Check(cfg *Config) error {
-	_, err := newTargets(cfg)
+	_, err := newTargets(cfg, true)
 	return err
 }
 
 func (cradle *Cradle) Reload(config *Config) error {
-	log := zap.L()
-	targets, err := newTargets(config)
+	err := cradle.reload(config)
+	cradle.metrics.observeReload(err)
+	return err
+}
+
+// ReloadFrom reads the main config file by load, and reloads with it.
+// Failing to read it is counted as a failed reload, like failing to reload.
+func (cradle *Cradle) ReloadFrom(load func() (*Config, error)) error {
+	config, err := load()
 	if err != nil {
-		log.Error("Failed to read config file. Nothing reloaded.", zap.Error(err))
+		zap.L().Error("Failed to read config file. Nothing reloaded.", zap.Error(err))
+		cradle.metrics.observeReload(err)
 		return err
 	}
-	newServer, err := cradle.createServer(config)
+	return cradle.Reload(config)
+}
+
+func (cradle *Cradle) reload(config *Config) error {
+	cradle.reloading.Lock()
+	defer cradle.reloading.Unlock()
+	log := zap.L()
+	targets, err := newTargets(config, false)
 	if err != nil {
-		log.Error("Failed to create server. Nothing reloaded.", zap.Error(err))
+		log.Error("Failed to read config file. Nothing reloaded.", zap.Error(err))
 		return err
 	}
-	newRunner, err := cradle.createRunner(targets)
+	oldTargets := cradle.Targets()
+	reuseUnchangedTargets(oldTargets, targets)
+	newServer, err := cradle.createServer(config, targets)
 	if err != nil {
-		log.Error("Failed to create runner. Nothing reloaded.", zap.Error(err))
+		log.Error("Failed to create server. Nothing reloaded.", zap.Error(err))
 		return err
 	}
-
 	cradle.targetsValue.Store(targets)
 	cradle.configValue.Store(config)
 	// Swap server
@@ -79,11 +117,23 @@ func (cradle *Cradle) Reload(config *Config) error {
 	if oldServer != nil {
 		oldServer.Shutdown()
 	}
-	// Swap runner
-	oldRunner := cradle.Runner()
-	cradle.runnerValue.Store(newRunner)
-	if oldRunner != nil {
-		oldRunner.Shutdown()
+	// Start and stop only the changed daemons and cron jobs
+	cradle.Runner().Update(targets)
+	// Forget the removed targets
+	cradle.lastErrorTimestamps.Range(func(name, _ interface{}) bool {
+		if _, ok := targets[name.(string)]; !ok {
+			cradle.lastErrorTimestamps.Delete(name)
+		}
+		return true
+	})
+	// Release the connections kept by the dropped targets
+	for name, target := range oldTargets {
+		if targets[name] == target {
+			continue
+		}
+		if closer, ok := target.(idleConnectionsCloser); ok {
+			closer.closeIdleConnections()
+		}
 	}
 	return nil
 }
@@ -125,6 +175,9 @@ func (cradle *Cradle) Run() error {
 
 func (cradle *Cradle) Shutdown() error {
 	cradle.haltedValue.Store(true)
+	cradle.haltOnce.Do(func() {
+		close(cradle.haltCh)
+	})
 	if server := cradle.Server(); server != nil {
 		server.Shutdown()
 	}
@@ -169,38 +222,12 @@ func (cradle *Cradle) isHalted() bool {
 }
 
 // ---
-func (cradle *Cradle) createRunner(targets map[string]Target) (*Runner, error) {
-	ctx, cancel := context.WithCancel(context.Background())
-	r := Runner{
-		context: ctx,
-		cancel:  cancel,
-		targets: targets,
-		cron:    cron.New(),
-		daemons: make([]*ServiceTarget, 0),
-	}
-	for _, target := range r.targets {
-		switch target := target.(type) {
-		case *CronJobTarget:
-			config := target.Config.CronJobConfig
-			err := r.cron.AddFunc(config.Every, func() {
-				_ = target.update(r.context)
-			})
-			if err != nil {
-				return nil, err
-			}
-		case *ServiceTarget:
-			r.daemons = append(r.daemons, target)
-		}
-	}
-	return &r, nil
-}
-
-func (cradle *Cradle) createServer(config *Config) (*Server, error) {
+func (cradle *Cradle) createServer(config *Config, targets map[string]Target) (*Server, error) {
 	if config == nil {
 		return nil, fmt.Errorf("config is nil or wrong interface: config=%v", cradle.configValue.Load())
 	}
 	var tlsConfig *tls.Config = nil
-	if len(config.Web.ServerTLSKeyPath) > 0 && len(config.Web.ServerTLSKeyPath) > 0 {
+	if len(config.Web.ServerTLSCertPath) > 0 && len(config.Web.ServerTLSKeyPath) > 0 {
 		serverCert, err := tls.LoadX509KeyPair(config.Web.ServerTLSCertPath, config.Web.ServerTLSKeyPath)
 		if err != nil {
 			return nil, fmt.Errorf("could not parse key/cert: %v", err)
@@ -223,7 +250,7 @@ func (cradle *Cradle) createServer(config *Config) (*Server, error) {
 			ClientCAs:          clientCAs,
 		}
 	}
-	handler := cradle.createServerHandler(config)
+	handler := cradle.createServerHandler(config, targets)
 	server := Server{
 		listenAddress: config.Web.ListenAddress,
 		tlsConfig:     tlsConfig,
@@ -233,7 +260,7 @@ func (cradle *Cradle) createServer(config *Config) (*Server, error) {
 	return &server, nil
 }
 
-func (cradle *Cradle) createServerHandler(config *Config) *mux.Router {
+func (cradle *Cradle) createServerHandler(config *Config, targets map[string]Target) *mux.Router {
 	log := zap.L()
 	r := mux.NewRouter().StrictSlash(true)
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -246,6 +273,13 @@ func (cradle *Cradle) createServerHandler(config *Config) *mux.Router {
 				}
 				return name
 			},
+			"daemonStatus": func(target Target) *DaemonStatus {
+				if daemon, ok := target.(*ServiceTarget); ok {
+					status := daemon.Status()
+					return &status
+				}
+				return nil
+			},
 		}
 		t, err := template.New("index").Funcs(funcMap).Parse(`
 <html>
@@ -261,7 +295,12 @@ func (cradle *Cradle) createServerHandler(config *Config) *mux.Router {
 		<h2>Enabled Targets</h2>
 			<ul>
 			{{ range $key, $value := .Targets }}
-				<li> [{{ typeOf $value }}] {{ html $key }}</li>
+				<li> [{{ typeOf $value }}] {{ html $key }}
+				{{ with daemonStatus $value }}
+					(state: {{ .State }} since {{ .Since.Format "2006-01-02 15:04:05" }}, restarts: {{ .Restarts }}, last exit code: {{ .LastExitCode }}{{ if $.Config.Web.EnableDaemonLogs }},
+					<a href="/targets/{{ urlquery $key }}/logs">logs</a>{{ end }})
+				{{ end }}
+				</li>
 			{{ end }}
 			</ul>
 		</body>
@@ -289,21 +328,62 @@ func (cradle *Cradle) createServerHandler(config *Config) *mux.Router {
 				zap.Int("response-size", outSize))
 		}
 	})
-	r.Handle(config.Web.MetricPath, promhttp.Handler())
+	r.Handle(config.Web.MetricPath, promhttp.InstrumentMetricHandler(cradle.registry, promhttp.HandlerFor(cradle.registry, promhttp.HandlerOpts{})))
 	r.HandleFunc(config.Web.ProbePath, func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+		begin := time.Now()
 		targets := cradle.Targets()
-		if targets != nil {
-			for name, target := range targets {
-				var buff bytes.Buffer
-				target.Scrape(r.Context(), &buff)
-				_, _ = io.WriteString(w, "################################################################################\n")
-				_, _ = io.WriteString(w, fmt.Sprintf("### From: %s\n", name))
-				_, _ = io.WriteString(w, "################################################################################\n\n")
-				_, _ = io.Copy(w, &buff)
-				_, _ = w.Write([]byte("\n"))
-			}
+		names, err := selectTargets(targets, r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
+		if len(names) == 0 && len(targets) > 0 {
+			http.Error(w, "No target matched", http.StatusNotFound)
+			return
+		}
+		format := negotiateFormat(w, r)
+		out, closeOut := compressResponse(w, r)
+		cradle.probe(out, r, config, targets, names, format)
+		if err := closeOut(); err != nil {
+			log.Warn("Failed to write entire probe response", zap.String("endpoint", r.URL.Path), zap.Error(err))
+		}
+		cradle.metrics.observeProbe(time.Since(begin))
 	})
+	if config.Web.EnableDaemonLogs {
+		r.HandleFunc("/targets/{name}/logs", func(w http.ResponseWriter, r *http.Request) {
+			daemon, ok := cradle.Targets()[mux.Vars(r)["name"]].(*ServiceTarget)
+			if !ok {
+				http.Error(w, "Service target not found", http.StatusNotFound)
+				return
+			}
+			var out bytes.Buffer
+			if err := daemon.WriteLogs(&out, r.URL.Query().Get("stream")); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+			if _, err := out.WriteTo(w); err != nil {
+				log.Warn("Failed to write entire logs", zap.String("endpoint", r.URL.Path), zap.Error(err))
+			}
+		})
+	}
+	for name := range targets {
+		name := name
+		r.HandleFunc(path.Join(config.Web.ProbePath, name), func(w http.ResponseWriter, r *http.Request) {
+			begin := time.Now()
+			targets := cradle.Targets()
+			if _, ok := targets[name]; !ok {
+				http.Error(w, "Target not found", http.StatusNotFound)
+				return
+			}
+			format := negotiateFormat(w, r)
+			out, closeOut := compressResponse(w, r)
+			cradle.probe(out, r, config, targets, []string{name}, format)
+			if err := closeOut(); err != nil {
+				log.Warn("Failed to write entire probe response", zap.String("endpoint", r.URL.Path), zap.Error(err))
+			}
+			cradle.metrics.observeProbe(time.Since(begin))
+		})
+	}
 	return r
 }
@@ -0,0 +1,188 @@
+package cradle
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// newTestCradle makes a cradle loading the target config files in a temporary include dir.
+func newTestCradle(t *testing.T, files map[string]string) (*Cradle, *Config) {
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config, err := ReadConfig([]byte("include_dirs: ['" + dir + "']\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Web.ProbePath = "/probe"
+	config.Web.MetricPath = "/metrics"
+	config.Web.ListenAddress = "127.0.0.1:0"
+	cradle := New(config)
+	t.Cleanup(func() {
+		_ = cradle.Shutdown()
+	})
+	if err := cradle.Reload(config); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	return cradle, config
+}
+
+// serve requests the path to the server of the cradle.
+func serve(cradle *Cradle, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	cradle.Server().handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec
+}
+
+// get requests the path to the server of the cradle, and returns the body.
+func get(t *testing.T, cradle *Cradle, path string) string {
+	rec := serve(cradle, path)
+	if rec.Code != 200 {
+		t.Fatalf("Unexpected status of %s: %d", path, rec.Code)
+	}
+	return rec.Body.String()
+}
+
+func TestProbeTargetStatus(t *testing.T) {
+	dir := t.TempDir()
+	metrics := filepath.Join(dir, "metrics.prom")
+	if err := ioutil.WriteFile(metrics, []byte("# TYPE answer gauge\nanswer 42\nquestion 0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cradle, config := newTestCradle(t, map[string]string{
+		"good.yml": "static: {paths: ['" + metrics + "']}\n",
+		"bad.yml":  "static: {paths: ['" + filepath.Join(dir, "missing.prom") + "']}\n",
+	})
+	output := get(t, cradle, "/probe")
+	for _, line := range []string{
+		`cradle_target_up{target="good"} 1`,
+		`cradle_target_up{target="bad"} 0`,
+		`cradle_target_scrape_samples{target="good"} 2`,
+		`cradle_target_scrape_samples{target="bad"} 0`,
+		`cradle_target_last_error_timestamp_seconds{target="good"} 0`,
+		`cradle_target_scrape_duration_seconds{target="good"} `,
+	} {
+		if !strings.Contains(output, line) {
+			t.Errorf("%s not found:\n%s", line, output)
+		}
+	}
+	if strings.Contains(output, `cradle_target_last_error_timestamp_seconds{target="bad"} 0`) {
+		t.Errorf("Last error of the failed target must be recorded:\n%s", output)
+	}
+	if _, ok := cradle.lastErrorTimestamps.Load("bad"); !ok {
+		t.Fatal("Last error of the failed target must be kept")
+	}
+
+	// The removed target must be forgotten.
+	if err := os.Remove(filepath.Join(config.IncludeDirs[0], "bad.yml")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cradle.Reload(config); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if _, ok := cradle.lastErrorTimestamps.Load("bad"); ok {
+		t.Error("Last error of the removed target must be forgotten")
+	}
+	if output := get(t, cradle, "/probe"); strings.Contains(output, `target="bad"`) {
+		t.Errorf("Removed target must not be probed:\n%s", output)
+	}
+}
+
+func TestProbeReservedFamilies(t *testing.T) {
+	// Like the output of /probe of another cradle.
+	metrics := filepath.Join(t.TempDir(), "metrics.prom")
+	if err := ioutil.WriteFile(metrics, []byte("# TYPE cradle_target_up gauge\ncradle_target_up{target=\"other\"} 1\n# TYPE answer gauge\nanswer 42\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cradle, _ := newTestCradle(t, map[string]string{
+		"upstream.yml": "static: {paths: ['" + metrics + "']}\n",
+	})
+	output := get(t, cradle, "/probe")
+	if n := strings.Count(output, "# TYPE cradle_target_up "); n != 1 {
+		t.Errorf("cradle_target_up must be exposed once, but %d times:\n%s", n, output)
+	}
+	var parser expfmt.TextParser
+	if _, err := parser.TextToMetricFamilies(strings.NewReader(output)); err != nil {
+		t.Errorf("Output must be parsed: %v\n%s", err, output)
+	}
+	for _, line := range []string{
+		`cradle_probe_type_conflict{family="cradle_target_up",target="upstream",type="gauge"} 1`,
+		`answer{cradle_target="upstream"} 42`,
+	} {
+		if !strings.Contains(output, line) {
+			t.Errorf("%s not found:\n%s", line, output)
+		}
+	}
+	if strings.Contains(output, `target="other"`) {
+		t.Errorf("Scraped family of a reserved name must be dropped:\n%s", output)
+	}
+}
+
+func TestDaemonLogsOptIn(t *testing.T) {
+	cradle, config := newTestCradle(t, map[string]string{
+		"daemon.yml": "service: {path: '/bin/sh', args: ['-c', 'echo secret; sleep 30']}\n",
+	})
+	daemon := cradle.Targets()["daemon"].(*ServiceTarget)
+	waitFor(t, 5*time.Second, "the daemon to write", func() bool {
+		return len(daemon.stdout.Lines()) > 0
+	})
+	if rec := serve(cradle, "/targets/daemon/logs"); rec.Code != http.StatusNotFound {
+		t.Errorf("Logs must not be served by default: %d", rec.Code)
+	}
+	if strings.Contains(get(t, cradle, "/"), "/targets/daemon/logs") {
+		t.Error("Index must not link to the logs by default")
+	}
+	config.Web.EnableDaemonLogs = true
+	if err := cradle.Reload(config); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if output := get(t, cradle, "/targets/daemon/logs"); !strings.Contains(output, "secret") {
+		t.Errorf("Logs must be served when enabled:\n%s", output)
+	}
+	if !strings.Contains(get(t, cradle, "/"), "/targets/daemon/logs") {
+		t.Error("Index must link to the logs when enabled")
+	}
+}
+
+func TestConcurrentReloads(t *testing.T) {
+	service := func(n int) string {
+		return fmt.Sprintf("service: {path: /bin/sh, args: ['-c', 'sleep 30 # %d']}\n", n)
+	}
+	cradle, config := newTestCradle(t, map[string]string{"svc.yml": service(0)})
+	for n := 1; n <= 20; n++ {
+		if err := ioutil.WriteFile(filepath.Join(config.IncludeDirs[0], "svc.yml"), []byte(service(n)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := cradle.Reload(config); err != nil {
+					t.Errorf("Failed to reload: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+		runner := cradle.Runner()
+		runner.mutex.Lock()
+		j := runner.jobs["svc"]
+		runner.mutex.Unlock()
+		if j == nil || j.target != cradle.Targets()["svc"] {
+			t.Fatalf("The runner must supervise the target of the last reload: %v", j)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package cradle
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	defaultLogLines = 1000
+	// maxLogLineLength is the length to split longer lines at,
+	// so that the kept lines of a daemon never hold more than log_lines times it.
+	maxLogLineLength = 64 * 1024
+)
+
+// logLine is a line written by a daemon.
+type logLine struct {
+	time   time.Time
+	stream string
+	text   string
+}
+
+// daemonLog receives what a daemon writes to stdout or stderr.
+// It splits them into lines, logs each line, and keeps the last lines in a ring buffer.
+type daemonLog struct {
+	target  string
+	stream  string
+	level   zapcore.Level
+	mutex   sync.Mutex
+	partial []byte
+	lines   []logLine
+	next    int
+}
+
+func newDaemonLog(target string, stream string, level zapcore.Level, size int) *daemonLog {
+	if size <= 0 {
+		size = defaultLogLines
+	}
+	return &daemonLog{
+		target: target,
+		stream: stream,
+		level:  level,
+		lines:  make([]logLine, 0, size),
+	}
+}
+
+func (l *daemonLog) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.partial = append(l.partial, p...)
+	for {
+		idx := bytes.IndexByte(l.partial, '\n')
+		if idx >= 0 && idx <= maxLogLineLength {
+			l.addLine(string(bytes.TrimSuffix(l.partial[:idx], []byte("\r"))))
+			l.partial = l.partial[idx+1:]
+			continue
+		}
+		if len(l.partial) <= maxLogLineLength {
+			break
+		}
+		// The line is too long, with or without newline; split it.
+		l.addLine(string(l.partial[:maxLogLineLength]))
+		l.partial = l.partial[maxLogLineLength:]
+	}
+	if cap(l.partial) > 2*maxLogLineLength {
+		// Do not keep the array of a large write only for the rest of it.
+		l.partial = append([]byte(nil), l.partial...)
+	}
+	return len(p), nil
+}
+
+// Flush adds the last line without newline. Call it when the daemon exited.
+func (l *daemonLog) Flush() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.partial) > 0 {
+		l.addLine(string(l.partial))
+		l.partial = nil
+	}
+}
+
+func (l *daemonLog) addLine(text string) {
+	if ce := zap.L().Check(l.level, "daemon/"+l.stream); ce != nil {
+		ce.Write(zap.String("target", l.target), zap.String("line", text))
+	}
+	line := logLine{
+		time:   time.Now(),
+		stream: l.stream,
+		text:   text,
+	}
+	if len(l.lines) < cap(l.lines) {
+		l.lines = append(l.lines, line)
+		return
+	}
+	l.lines[l.next] = line
+	l.next = (l.next + 1) % len(l.lines)
+}
+
+// Lines returns the kept lines, from the oldest.
+func (l *daemonLog) Lines() []logLine {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	lines := make([]logLine, 0, len(l.lines))
+	lines = append(lines, l.lines[l.next:]...)
+	lines = append(lines, l.lines[:l.next]...)
+	return lines
+}
+
+// writeDaemonLogs writes the lines of the logs, merged in time order.
+func writeDaemonLogs(w io.Writer, logs ...*daemonLog) error {
+	lines := make([]logLine, 0)
+	for _, l := range logs {
+		lines = append(lines, l.Lines()...)
+	}
+	sort.SliceStable(lines, func(i, j int) bool {
+		return lines[i].time.Before(lines[j].time)
+	})
+	for _, line := range lines {
+		if _, err := io.WriteString(w, line.time.Format(time.RFC3339Nano)+" "+line.stream+" "+line.text+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
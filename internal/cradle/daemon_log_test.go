@@ -0,0 +1,51 @@
+package cradle
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func TestDaemonLog(t *testing.T) {
+	l := newDaemonLog("service", "stdout", zapcore.InfoLevel, 3)
+	_, _ = l.Write([]byte("line1\nli"))
+	_, _ = l.Write([]byte("ne2\r\nline3\n"))
+	_, _ = l.Write([]byte("line4\nline5"))
+	l.Flush()
+	texts := make([]string, 0)
+	for _, line := range l.Lines() {
+		texts = append(texts, line.text)
+	}
+	expected := []string{"line3", "line4", "line5"}
+	if !reflect.DeepEqual(texts, expected) {
+		t.Errorf("Lines do not match: %v != %v", texts, expected)
+	}
+}
+
+func TestDaemonLogLongLines(t *testing.T) {
+	l := newDaemonLog("service", "stdout", zapcore.DebugLevel, 100)
+	long := strings.Repeat("x", 2*maxLogLineLength+10)
+	// In a single write with newline, and in small writes without it.
+	_, _ = l.Write([]byte(long + "\nshort\n"))
+	for i := 0; i < len(long); i += 1000 {
+		end := i + 1000
+		if end > len(long) {
+			end = len(long)
+		}
+		_, _ = l.Write([]byte(long[i:end]))
+	}
+	l.Flush()
+	lengths := make([]int, 0)
+	for _, line := range l.Lines() {
+		lengths = append(lengths, len(line.text))
+	}
+	expected := []int{maxLogLineLength, maxLogLineLength, 10, 5, maxLogLineLength, maxLogLineLength, 10}
+	if !reflect.DeepEqual(lengths, expected) {
+		t.Errorf("Lengths of lines do not match: %v != %v", lengths, expected)
+	}
+	if cap(l.partial) > 2*maxLogLineLength {
+		t.Errorf("Large write must not be kept: %d", cap(l.partial))
+	}
+}
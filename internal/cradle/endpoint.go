@@ -0,0 +1,38 @@
+package cradle
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+const unixEndpointPrefix = "unix://"
+
+// unixSocketKey is the context key of the path of the Unix domain socket to send the request through.
+type unixSocketKey struct{}
+
+// newEndpointRequest makes a GET request to the endpoint.
+// Besides http(s) URLs, endpoints can be Unix domain sockets like "unix:///run/foo.sock:/metrics".
+// Such requests are sent through the socket by endpointTransport.
+func newEndpointRequest(ctx context.Context, endpoint string) (*http.Request, error) {
+	socket, path, ok := parseUnixEndpoint(endpoint)
+	if !ok {
+		return http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	}
+	ctx = context.WithValue(ctx, unixSocketKey{}, socket)
+	return http.NewRequestWithContext(ctx, "GET", "http://localhost"+path, nil)
+}
+
+// parseUnixEndpoint splits "unix:///run/foo.sock:/metrics" into the socket path and the HTTP path.
+// The HTTP path defaults to "/metrics".
+func parseUnixEndpoint(endpoint string) (string, string, bool) {
+	if !strings.HasPrefix(endpoint, unixEndpointPrefix) {
+		return "", "", false
+	}
+	socket := strings.TrimPrefix(endpoint, unixEndpointPrefix)
+	path := "/metrics"
+	if idx := strings.Index(socket, ":"); idx >= 0 {
+		socket, path = socket[:idx], socket[idx+1:]
+	}
+	return socket, path, true
+}
@@ -0,0 +1,62 @@
+package cradle
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestParseUnixEndpoint(t *testing.T) {
+	cases := []struct {
+		endpoint string
+		socket   string
+		path     string
+		ok       bool
+	}{
+		{"unix:///run/foo.sock:/metrics", "/run/foo.sock", "/metrics", true},
+		{"unix:///run/foo.sock:/probe?target=a", "/run/foo.sock", "/probe?target=a", true},
+		{"unix:///run/foo.sock", "/run/foo.sock", "/metrics", true},
+		{"http://localhost:9100/metrics", "", "", false},
+	}
+	for _, c := range cases {
+		socket, path, ok := parseUnixEndpoint(c.endpoint)
+		if socket != c.socket || path != c.path || ok != c.ok {
+			t.Errorf("Unexpected result for %s: (%s, %s, %v)", c.endpoint, socket, path, ok)
+		}
+	}
+}
+
+func TestScrapeUnixEndpoint(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix domain sockets are not tested on windows")
+	}
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "exporter.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("up{path=\"" + r.URL.Path + "\"} 1\n"))
+		}),
+	}
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	defer func() {
+		_ = server.Close()
+	}()
+	var buff bytes.Buffer
+	if err := scrapeEndpoint(context.Background(), &buff, "target", nil, "unix://"+socket+":/custom"); err != nil {
+		t.Fatalf("Failed to scrape: %v", err)
+	}
+	if !strings.Contains(buff.String(), `up{path="/custom"} 1`) {
+		t.Errorf("Unexpected output: %s", buff.String())
+	}
+}
@@ -0,0 +1,118 @@
+package cradle
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// healthCheck is a HealthCheckConfig checked and ready to run.
+type healthCheck struct {
+	config HealthCheckConfig
+	// client sends the request, if it is an http check.
+	client *http.Client
+	// process runs the command, if it is a command check.
+	process *process
+}
+
+// newHealthCheck checks the config. Http checks are sent by the client of the daemon,
+// and command checks are run with the same environment as the daemon.
+func newHealthCheck(name string, cfg *HealthCheckConfig, client *http.Client, daemon *ProcessConfig) (*healthCheck, error) {
+	if client == nil {
+		client = defaultEndpointClient
+	}
+	check := &healthCheck{
+		config: cfg.withDefaults(),
+		client: client,
+	}
+	kinds := 0
+	if len(cfg.HTTP) > 0 {
+		kinds++
+		if err := checkHealthCheckURL(cfg.HTTP); err != nil {
+			return nil, fmt.Errorf("invalid http check: %v", err)
+		}
+	}
+	if len(cfg.TCP) > 0 {
+		kinds++
+		if _, _, err := net.SplitHostPort(cfg.TCP); err != nil {
+			return nil, fmt.Errorf("invalid tcp check: %v", err)
+		}
+	}
+	if len(cfg.Command) > 0 {
+		kinds++
+		procCfg := *daemon
+		procCfg.Path = cfg.Command[0]
+		procCfg.Args = cfg.Command[1:]
+		procCfg.Stdin = nil
+		proc, err := newProcess(name, &procCfg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid command check: %v", err)
+		}
+		check.process = proc
+	}
+	if kinds != 1 {
+		return nil, fmt.Errorf("health check must have exactly one of http, tcp and command")
+	}
+	return check, nil
+}
+
+// checkHealthCheckURL checks the URL of an http check is an http(s) URL with a host, or a Unix domain socket endpoint.
+func checkHealthCheckURL(endpoint string) error {
+	if socket, _, ok := parseUnixEndpoint(endpoint); ok {
+		if len(socket) == 0 {
+			return fmt.Errorf("no socket path: %s", endpoint)
+		}
+		return nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme must be http, https or unix: %s", endpoint)
+	}
+	if len(u.Host) == 0 {
+		return fmt.Errorf("no host: %s", endpoint)
+	}
+	return nil
+}
+
+// run checks once. nil is returned when healthy.
+func (check *healthCheck) run(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, check.config.Timeout)
+	defer cancel()
+	switch {
+	case len(check.config.HTTP) > 0:
+		req, err := newEndpointRequest(ctx, check.config.HTTP)
+		if err != nil {
+			return err
+		}
+		resp, err := check.client.Do(req)
+		if err != nil {
+			return err
+		}
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode < 200 || 300 <= resp.StatusCode {
+			return fmt.Errorf("unexpected status: %s", resp.Status)
+		}
+		return nil
+	case len(check.config.TCP) > 0:
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", check.config.TCP)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	default:
+		cmd, err := check.process.command()
+		if err != nil {
+			return err
+		}
+		return check.process.run(ctx, cmd)
+	}
+}
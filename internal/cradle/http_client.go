@@ -0,0 +1,230 @@
+package cradle
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// idleConnectionsCloser is implemented by targets which keep connections to their endpoints.
+type idleConnectionsCloser interface {
+	closeIdleConnections()
+}
+
+// defaultEndpointClient is used to scrape endpoints of targets without their own client.
+var defaultEndpointClient = &http.Client{
+	Transport: &endpointTransport{
+		config: &HTTPClientConfig{},
+		base:   http.DefaultTransport.(*http.Transport),
+	},
+}
+
+// endpointTransport sends requests to the endpoints of a target, with the auth and headers in HTTPClientConfig.
+// Requests to Unix domain sockets are sent through transports dialing the sockets.
+type endpointTransport struct {
+	config *HTTPClientConfig
+	base   *http.Transport
+	// unix holds the transports by the path of the socket.
+	unix sync.Map
+}
+
+// newHTTPClient makes the client to scrape the endpoints of a target.
+// Files in the config are checked here, so that wrong paths are found by config check.
+func newHTTPClient(cfg *HTTPClientConfig) (*http.Client, error) {
+	if cfg == nil {
+		cfg = &HTTPClientConfig{}
+	}
+	tlsConfig, err := newTLSConfig(&cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.BasicAuth != nil && len(cfg.BearerTokenFile) > 0 {
+		return nil, fmt.Errorf("only one of basic_auth and bearer_token_file can be set")
+	}
+	if cfg.BasicAuth != nil && len(cfg.BasicAuth.PasswordFile) > 0 {
+		if _, err := readSecretFile(cfg.BasicAuth.PasswordFile); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.BearerTokenFile) > 0 {
+		if _, err := readSecretFile(cfg.BearerTokenFile); err != nil {
+			return nil, err
+		}
+	}
+	base, err := newTransport(cfg, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Transport: &endpointTransport{
+			config: cfg,
+			base:   base,
+		},
+		CheckRedirect: checkRedirect,
+	}, nil
+}
+
+// checkRedirect refuses redirects to other hosts or schemes,
+// because endpointTransport adds the auth and headers to every request, including redirected ones.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	// Same as the default of http.Client.
+	if len(via) >= 10 {
+		return fmt.Errorf("stopped after 10 redirects")
+	}
+	if origin := via[0].URL; req.URL.Host != origin.Host || req.URL.Scheme != origin.Scheme {
+		return fmt.Errorf("redirect to other host refused: %s", req.URL.Redacted())
+	}
+	return nil
+}
+
+// newTransport makes the transport tuned by the config.
+func newTransport(cfg *HTTPClientConfig, tlsConfig *tls.Config) (*http.Transport, error) {
+	// Same as http.DefaultTransport, unless configured.
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if cfg.DialTimeout > 0 {
+		dialer.Timeout = cfg.DialTimeout
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+	}
+	if len(cfg.ProxyURL) > 0 {
+		proxyURL, err := url.Parse(cfg.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy_url: %v", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	if cfg.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = cfg.TLSHandshakeTimeout
+	}
+	if cfg.MaxIdleConns > 0 {
+		transport.MaxIdleConnsPerHost = cfg.MaxIdleConns
+		if transport.MaxIdleConns < cfg.MaxIdleConns {
+			transport.MaxIdleConns = cfg.MaxIdleConns
+		}
+	}
+	if cfg.EnableHTTP2 != nil && !*cfg.EnableHTTP2 {
+		transport.ForceAttemptHTTP2 = false
+		// Non-nil empty map disables HTTP/2.
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return transport, nil
+}
+
+func newTLSConfig(cfg *TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if len(cfg.CAFile) > 0 {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA file: %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(cfg.CertFile) > 0 || len(cfg.KeyFile) > 0 {
+		if len(cfg.CertFile) == 0 || len(cfg.KeyFile) == 0 {
+			return nil, fmt.Errorf("both cert_file and key_file must be set")
+		}
+		if _, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile); err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		// Read every time, to use renewed certificates without reloading.
+		tlsConfig.GetClientCertificate = func(_ *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load client certificate: %v", err)
+			}
+			return &cert, nil
+		}
+	}
+	return tlsConfig, nil
+}
+
+// readSecretFile reads a password or token, without the trailing newline.
+func readSecretFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %v", err)
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+func (t *endpointTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrip must not modify the given request.
+	req = req.Clone(req.Context())
+	for name, value := range t.config.Headers {
+		req.Header.Set(name, value)
+	}
+	if auth := t.config.BasicAuth; auth != nil {
+		password := auth.Password
+		if len(auth.PasswordFile) > 0 {
+			var err error
+			if password, err = readSecretFile(auth.PasswordFile); err != nil {
+				return nil, err
+			}
+		}
+		req.SetBasicAuth(auth.Username, password)
+	}
+	if len(t.config.BearerTokenFile) > 0 {
+		token, err := readSecretFile(t.config.BearerTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if socket, ok := req.Context().Value(unixSocketKey{}).(string); ok {
+		return t.unixTransport(socket).RoundTrip(req)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// CloseIdleConnections is called by http.Client.CloseIdleConnections.
+func (t *endpointTransport) CloseIdleConnections() {
+	t.base.CloseIdleConnections()
+	t.unix.Range(func(_, transport interface{}) bool {
+		transport.(*http.Transport).CloseIdleConnections()
+		return true
+	})
+}
+
+func (t *endpointTransport) unixTransport(socket string) *http.Transport {
+	if transport, ok := t.unix.Load(socket); ok {
+		return transport.(*http.Transport)
+	}
+	transport := t.base.Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var dialer net.Dialer
+		if t.config.DialTimeout > 0 {
+			dialer.Timeout = t.config.DialTimeout
+		}
+		return dialer.DialContext(ctx, "unix", socket)
+	}
+	actual, _ := t.unix.LoadOrStore(socket, transport)
+	return actual.(*http.Transport)
+}
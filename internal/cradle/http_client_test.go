@@ -0,0 +1,128 @@
+package cradle
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPClient(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ := r.BasicAuth()
+		if username != "user" || password != "secret" || r.Header.Get("X-Scope") != "cradle" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte("up 1\n"))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPem, 0644); err != nil {
+		t.Fatal(err)
+	}
+	passwordFile := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(passwordFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	client, err := newHTTPClient(&HTTPClientConfig{
+		TLS:       TLSConfig{CAFile: caFile},
+		BasicAuth: &BasicAuthConfig{Username: "user", PasswordFile: passwordFile},
+		Headers:   map[string]string{"X-Scope": "cradle"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to make client: %v", err)
+	}
+	var buff bytes.Buffer
+	if err := scrapeEndpoint(context.Background(), &buff, "target", client, server.URL+"/metrics"); err != nil {
+		t.Fatalf("Failed to scrape: %v", err)
+	}
+	if !strings.Contains(buff.String(), "up 1") {
+		t.Errorf("Unexpected output: %s", buff.String())
+	}
+	if _, err := newHTTPClient(&HTTPClientConfig{BearerTokenFile: filepath.Join(dir, "no-such-file")}); err == nil {
+		t.Error("Client with missing token file must be rejected")
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	disabled := false
+	transport, err := newTransport(&HTTPClientConfig{
+		ProxyURL:              "http://proxy.example.com:3128",
+		DialTimeout:           time.Second,
+		ResponseHeaderTimeout: 2 * time.Second,
+		MaxIdleConns:          200,
+		EnableHTTP2:           &disabled,
+	}, nil)
+	if err != nil {
+		t.Fatalf("Failed to make transport: %v", err)
+	}
+	if transport.ResponseHeaderTimeout != 2*time.Second || transport.MaxIdleConnsPerHost != 200 || transport.MaxIdleConns != 200 {
+		t.Errorf("Transport not tuned: %+v", transport)
+	}
+	if transport.ForceAttemptHTTP2 || transport.TLSNextProto == nil {
+		t.Error("HTTP/2 must be disabled")
+	}
+	req, _ := http.NewRequest("GET", "http://localhost:9100/metrics", nil)
+	if proxy, err := transport.Proxy(req); err != nil || proxy.Host != "proxy.example.com:3128" {
+		t.Errorf("Unexpected proxy: %v, %v", proxy, err)
+	}
+	if _, err := newTransport(&HTTPClientConfig{ProxyURL: "://invalid"}, nil); err == nil {
+		t.Error("Invalid proxy_url must be rejected")
+	}
+}
+
+func TestHTTPClientRedirect(t *testing.T) {
+	leaked := make(chan string, 1)
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		leaked <- r.Header.Get("Authorization")
+		_, _ = w.Write([]byte("up 1\n"))
+	}))
+	defer other.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/moved":
+			http.Redirect(w, r, "/metrics", http.StatusFound)
+		case "/elsewhere":
+			http.Redirect(w, r, other.URL+"/metrics", http.StatusFound)
+		default:
+			if _, _, ok := r.BasicAuth(); !ok {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			_, _ = w.Write([]byte("up 1\n"))
+		}
+	}))
+	defer server.Close()
+	client, err := newHTTPClient(&HTTPClientConfig{BasicAuth: &BasicAuthConfig{Username: "user", Password: "secret"}})
+	if err != nil {
+		t.Fatalf("Failed to make client: %v", err)
+	}
+	var buff bytes.Buffer
+	if err := scrapeEndpoint(context.Background(), &buff, "target", client, server.URL+"/moved"); err != nil {
+		t.Errorf("Redirect to the same host must be followed: %v", err)
+	}
+	if err := scrapeEndpoint(context.Background(), &buff, "target", client, server.URL+"/elsewhere"); err == nil {
+		t.Error("Redirect to other host must be refused")
+	}
+	select {
+	case auth := <-leaked:
+		t.Errorf("Credentials must not be sent to other host: %q", auth)
+	default:
+	}
+
+	if _, err := newHTTPClient(&HTTPClientConfig{
+		BasicAuth:       &BasicAuthConfig{Username: "user", Password: "secret"},
+		BearerTokenFile: "/dev/null",
+	}); err == nil {
+		t.Error("Client with both basic auth and bearer token must be rejected")
+	}
+}
@@ -0,0 +1,88 @@
+package cradle
+
+import (
+	"errors"
+	"io"
+
+	"go.uber.org/atomic"
+)
+
+// errBodySizeLimit is returned when the output of a target exceeds its body_size_limit.
+var errBodySizeLimit = errors.New("body size limit exceeded")
+
+// sizeLimit is the size left for the output of a target, shared by the writers of its concurrent sub-scrapes.
+type sizeLimit struct {
+	remaining atomic.Int64
+	exceeded  atomic.Bool
+}
+
+// limitWriter passes up to limit bytes to w, and fails with errBodySizeLimit after that.
+// Writers made by share count against the same limit, and can be written concurrently.
+type limitWriter struct {
+	w io.Writer
+	// limit is nil for no limit.
+	limit *sizeLimit
+	// exceeded tells whether a write to this writer hit the limit.
+	exceeded bool
+}
+
+// newLimitWriter wraps w with the limit. limit <= 0 means no limit.
+func newLimitWriter(w io.Writer, limit ByteSize) *limitWriter {
+	lw := &limitWriter{
+		w: w,
+	}
+	if limit > 0 {
+		lw.limit = &sizeLimit{}
+		lw.limit.remaining.Store(int64(limit))
+	}
+	return lw
+}
+
+// share wraps w with the same limit as lw, for a sub-scrape written to its own buffer concurrently with others.
+// What is written to it is counted already; copy it to lw.w, not to lw.
+func (lw *limitWriter) share(w io.Writer) *limitWriter {
+	return &limitWriter{
+		w:     w,
+		limit: lw.limit,
+	}
+}
+
+// limitExceeded tells whether any writer sharing the limit hit it.
+func (lw *limitWriter) limitExceeded() bool {
+	return lw.limit != nil && lw.limit.exceeded.Load()
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	if lw.limit == nil {
+		return lw.w.Write(p)
+	}
+	// Take the size out of the limit before writing, so that concurrent writers never pass more than it in total.
+	var size int64
+	for {
+		remaining := lw.limit.remaining.Load()
+		size = int64(len(p))
+		if remaining < size {
+			size = remaining
+		}
+		if lw.limit.remaining.CAS(remaining, remaining-size) {
+			break
+		}
+	}
+	n, err := lw.w.Write(p[:size])
+	if unused := size - int64(n); unused > 0 {
+		lw.limit.remaining.Add(unused)
+	}
+	if err != nil {
+		return n, err
+	}
+	if n < len(p) {
+		lw.exceeded = true
+		lw.limit.exceeded.Store(true)
+		return n, errBodySizeLimit
+	}
+	return n, nil
+}
+
+func (lw *limitWriter) startSection() {
+	startSection(lw.w)
+}
@@ -0,0 +1,58 @@
+package cradle
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func checkLimits(cfg *ProcessConfig) error {
+	if cfg.Nice != nil && (*cfg.Nice < -20 || 19 < *cfg.Nice) {
+		return fmt.Errorf("nice must be from -20 to 19: %d", *cfg.Nice)
+	}
+	return nil
+}
+
+// applyLimits sets the limits and niceness of the started process.
+// Go cannot run code between fork and exec, so they are applied just after it started, on a best-effort basis:
+// what it does at the very beginning is not limited, and children forked by then do not inherit the limits.
+// The niceness is set to the whole process group, so that it covers such children too.
+func applyLimits(pid int, cfg *ProcessConfig) error {
+	limits := []struct {
+		resource int
+		value    uint64
+	}{
+		{unix.RLIMIT_CPU, cfg.Limits.CPU},
+		{unix.RLIMIT_AS, cfg.Limits.AddressSpace},
+		{unix.RLIMIT_NOFILE, cfg.Limits.NoFile},
+		{unix.RLIMIT_NPROC, cfg.Limits.NProc},
+	}
+	for _, limit := range limits {
+		if limit.value == 0 {
+			continue
+		}
+		rlimit := &unix.Rlimit{Cur: limit.value, Max: limit.value}
+		if err := prlimit(pid, limit.resource, rlimit); err != nil {
+			return err
+		}
+	}
+	if cfg.Nice != nil {
+		// The process leads its own process group.
+		if err := syscall.Setpriority(syscall.PRIO_PGRP, pid, *cfg.Nice); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prlimit sets the limit of another process.
+// unix.Prlimit is not exported in the version of x/sys we depend on.
+func prlimit(pid int, resource int, limit *unix.Rlimit) error {
+	_, _, errno := unix.RawSyscall6(unix.SYS_PRLIMIT64, uintptr(pid), uintptr(resource), uintptr(unsafe.Pointer(limit)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
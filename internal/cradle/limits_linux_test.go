@@ -0,0 +1,39 @@
+package cradle
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestApplyLimits(t *testing.T) {
+	nice := 5
+	cfg := &ProcessConfig{
+		Path: "/bin/sh",
+		// Limits are applied just after the process started, so wait for them.
+		Args:   []string{"-c", "sleep 0.2; ulimit -n; nice"},
+		Nice:   &nice,
+		Limits: LimitsConfig{NoFile: 100},
+	}
+	p, err := newProcess("script", cfg)
+	if err != nil {
+		t.Fatalf("Failed to make process: %v", err)
+	}
+	cmd, err := p.command()
+	if err != nil {
+		t.Fatalf("Failed to make command: %v", err)
+	}
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := p.run(context.Background(), cmd); err != nil {
+		t.Fatalf("Failed to run: %v", err)
+	}
+	if output := stdout.String(); output != "100\n5\n" {
+		t.Errorf("Limits are not applied: %q", output)
+	}
+
+	invalid := -21
+	if _, err := newProcess("script", &ProcessConfig{Path: "/bin/true", Nice: &invalid}); err == nil {
+		t.Error("Invalid nice must be rejected")
+	}
+}
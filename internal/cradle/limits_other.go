@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package cradle
+
+import "fmt"
+
+func checkLimits(cfg *ProcessConfig) error {
+	if cfg.Nice != nil || cfg.Limits != (LimitsConfig{}) {
+		return fmt.Errorf("nice and limits are supported only on linux")
+	}
+	return nil
+}
+
+func applyLimits(_ int, _ *ProcessConfig) error {
+	return nil
+}
@@ -0,0 +1,304 @@
+package cradle
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// conflictFamilyName is the name of the family made by conflictFamily.
+const conflictFamilyName = "cradle_probe_type_conflict"
+
+// reservedFamilyNames are the families made by cradle itself on the probe path.
+// Scraped families of the same names, like the ones of another cradle, are dropped as conflicts.
+var reservedFamilyNames = map[string]bool{
+	targetUpFamilyName:             true,
+	targetScrapeDurationFamilyName: true,
+	targetScrapeSamplesFamilyName:  true,
+	targetLastErrorFamilyName:      true,
+	conflictFamilyName:             true,
+}
+
+type typeConflict struct {
+	family string
+	target string
+	typ    string
+}
+
+// metricMerger groups the samples of all targets by metric family,
+// so that each family is exposed with exactly one HELP and TYPE line.
+type metricMerger struct {
+	families  map[string]*dto.MetricFamily
+	conflicts []typeConflict
+	comments  bytes.Buffer
+	self      []*dto.MetricFamily
+	// types, units and created are kept from targets in the OpenMetrics format, see openMetricsMeta.
+	types   map[string]string
+	units   map[string]string
+	created map[*dto.Metric]float64
+}
+
+func newMetricMerger() *metricMerger {
+	return &metricMerger{
+		families:  make(map[string]*dto.MetricFamily),
+		conflicts: make([]typeConflict, 0),
+		self:      make([]*dto.MetricFamily, 0),
+		types:     make(map[string]string),
+		units:     make(map[string]string),
+		created:   make(map[*dto.Metric]float64),
+	}
+}
+
+// add parses the output of a target and merges it, adding the labels of the target to every sample.
+// The output is split into sections by sectionWriter, and each of them is parsed on its own.
+// Comment lines are kept as they are, and written before all metric families.
+// It returns the number of merged samples, and an error if any part of the output could not be parsed.
+func (m *metricMerger) add(targetName string, cfg *TargetConfig, sections [][]byte) (int, error) {
+	_, _ = io.WriteString(&m.comments, "################################################################################\n")
+	_, _ = io.WriteString(&m.comments, "### From: "+targetName+"\n")
+	_, _ = io.WriteString(&m.comments, "################################################################################\n")
+	total := 0
+	errs := make([]error, 0)
+	for _, section := range sections {
+		samples, err := m.addSection(targetName, cfg, section)
+		total += samples
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	_, _ = io.WriteString(&m.comments, "\n")
+	return total, combineErrors(errs)
+}
+
+// addError records a target which failed to be scraped as a whole.
+func (m *metricMerger) addError(targetName string, err error) {
+	_, _ = io.WriteString(&m.comments, "################################################################################\n")
+	_, _ = io.WriteString(&m.comments, "### From: "+targetName+"\n")
+	_, _ = io.WriteString(&m.comments, "################################################################################\n")
+	_, _ = io.WriteString(&m.comments, "### Err: Failed to scrape target\n")
+	_, _ = io.WriteString(&m.comments, promCommentOut(err.Error()))
+	_, _ = io.WriteString(&m.comments, "\n")
+}
+
+// addSelfFamily adds a metric family made by cradle itself, which is written after all the scraped ones.
+func (m *metricMerger) addSelfFamily(family *dto.MetricFamily) {
+	m.self = append(m.self, family)
+}
+
+func (m *metricMerger) addSection(targetName string, cfg *TargetConfig, section []byte) (int, error) {
+	for _, line := range bytes.Split(section, []byte("\n")) {
+		if bytes.HasPrefix(line, []byte("### ")) {
+			_, _ = m.comments.Write(line)
+			_, _ = io.WriteString(&m.comments, "\n")
+		}
+	}
+	var families map[string]*dto.MetricFamily
+	var meta *openMetricsMeta
+	var err error
+	if isOpenMetrics(section) {
+		families, meta, err = parseOpenMetrics(section)
+	} else {
+		var parser expfmt.TextParser
+		families, err = parser.TextToMetricFamilies(bytes.NewReader(section))
+	}
+	if err != nil {
+		_, _ = io.WriteString(&m.comments, "### Err: Failed to parse output\n")
+		_, _ = io.WriteString(&m.comments, promCommentOut(err.Error()))
+		return 0, err
+	}
+	if meta != nil {
+		for name, unit := range meta.units {
+			if _, ok := m.units[name]; !ok {
+				m.units[name] = unit
+			}
+		}
+		for metric, created := range meta.created {
+			m.created[metric] = created
+		}
+	}
+	samples := 0
+	labels := cfg.TargetLabels()
+	for name, family := range families {
+		for _, metric := range family.Metric {
+			applyTargetLabels(metric, labels, cfg.HonorLabels)
+		}
+		typ := ""
+		if meta != nil {
+			typ = meta.types[name]
+		}
+		if isReservedFamily(family) {
+			m.addConflict(name, targetName, family, typ)
+			continue
+		}
+		merged, ok := m.families[name]
+		if !ok {
+			m.families[name] = family
+			if len(typ) > 0 {
+				m.types[name] = typ
+			}
+			samples += countSamples(family)
+			continue
+		}
+		if merged.GetType() != family.GetType() || m.types[name] != typ {
+			m.addConflict(name, targetName, family, typ)
+			continue
+		}
+		if len(merged.GetHelp()) == 0 && len(family.GetHelp()) > 0 {
+			merged.Help = family.Help
+		}
+		merged.Metric = append(merged.Metric, family.Metric...)
+		samples += countSamples(family)
+	}
+	return samples, nil
+}
+
+// addConflict records the family of the target dropped by a conflict. typ is its OpenMetrics type if any.
+func (m *metricMerger) addConflict(name string, targetName string, family *dto.MetricFamily, typ string) {
+	if len(typ) == 0 {
+		typ = strings.ToLower(family.GetType().String())
+	}
+	m.conflicts = append(m.conflicts, typeConflict{
+		family: name,
+		target: targetName,
+		typ:    typ,
+	})
+}
+
+// isReservedFamily tells whether the scraped family would be exposed by the name of a family made by cradle itself;
+// the name of a counter or an info may lose its suffix in OpenMetrics.
+func isReservedFamily(family *dto.MetricFamily) bool {
+	name := family.GetName()
+	return reservedFamilyNames[name] ||
+		reservedFamilyNames[strings.TrimSuffix(name, "_total")] ||
+		reservedFamilyNames[strings.TrimSuffix(name, "_info")]
+}
+
+// countSamples counts samples in the family, as Prometheus counts lines of the text format.
+func countSamples(family *dto.MetricFamily) int {
+	samples := 0
+	for _, metric := range family.Metric {
+		switch family.GetType() {
+		case dto.MetricType_SUMMARY:
+			samples += len(metric.GetSummary().GetQuantile()) + 2
+		case dto.MetricType_HISTOGRAM:
+			samples += len(metric.GetHistogram().GetBucket()) + 2
+		default:
+			samples++
+		}
+	}
+	return samples
+}
+
+// writeTo writes all the merged families in the text exposition format, sorted by name.
+func (m *metricMerger) writeTo(w io.Writer) error {
+	if _, err := m.comments.WriteTo(w); err != nil {
+		return err
+	}
+	for _, family := range m.sortedFamilies() {
+		families := []*dto.MetricFamily{family}
+		if m.types[family.GetName()] == "gaugehistogram" {
+			families = gaugeHistogramFamilies(family)
+		}
+		for _, family := range families {
+			if _, err := expfmt.MetricFamilyToText(w, family); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeOpenMetricsTo writes all the merged families in the OpenMetrics text format, sorted by name.
+// Comments are left out, because OpenMetrics does not allow them.
+func (m *metricMerger) writeOpenMetricsTo(w io.Writer) error {
+	for _, family := range m.sortedFamilies() {
+		if err := writeOpenMetricsFamily(w, family, m.types[family.GetName()], m.units[family.GetName()], m.created); err != nil {
+			return err
+		}
+	}
+	_, err := expfmt.FinalizeOpenMetrics(w)
+	return err
+}
+
+// sortedFamilies returns the merged families sorted by name,
+// followed by the type conflicts and the non-empty families made by cradle itself.
+func (m *metricMerger) sortedFamilies() []*dto.MetricFamily {
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	families := make([]*dto.MetricFamily, 0, len(names)+len(m.self)+1)
+	for _, name := range names {
+		families = append(families, m.families[name])
+	}
+	if family := m.conflictFamily(); family != nil {
+		families = append(families, family)
+	}
+	for _, family := range m.self {
+		if len(family.Metric) > 0 {
+			families = append(families, family)
+		}
+	}
+	return families
+}
+
+func (m *metricMerger) conflictFamily() *dto.MetricFamily {
+	if len(m.conflicts) == 0 {
+		return nil
+	}
+	family := &dto.MetricFamily{
+		Name: proto.String(conflictFamilyName),
+		Help: proto.String("Metric family dropped from a target because its TYPE conflicts with the one exposed by another target, or its name is used by cradle itself."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	for _, conflict := range m.conflicts {
+		family.Metric = append(family.Metric, &dto.Metric{
+			Label: []*dto.LabelPair{
+				{Name: proto.String("family"), Value: proto.String(conflict.family)},
+				{Name: proto.String("target"), Value: proto.String(conflict.target)},
+				{Name: proto.String("type"), Value: proto.String(conflict.typ)},
+			},
+			Gauge: &dto.Gauge{Value: proto.Float64(1)},
+		})
+	}
+	return family
+}
+
+// applyTargetLabels adds the labels of a target to a scraped sample.
+// When the sample already has a label of the same name, the scraped one is kept if honorLabels is set.
+// Otherwise it is renamed to "exported_<name>", just like Prometheus does.
+func applyTargetLabels(metric *dto.Metric, labels map[string]string, honorLabels bool) {
+	scraped := make(map[string]*dto.LabelPair, len(metric.Label))
+	for _, pair := range metric.Label {
+		scraped[pair.GetName()] = pair
+	}
+	for name, value := range labels {
+		pair, ok := scraped[name]
+		if ok && honorLabels {
+			continue
+		}
+		if ok {
+			exported := "exported_" + name
+			for _, exists := scraped[exported]; exists; _, exists = scraped[exported] {
+				exported = "exported_" + exported
+			}
+			pair.Name = proto.String(exported)
+			scraped[exported] = pair
+		}
+		newPair := &dto.LabelPair{
+			Name:  proto.String(name),
+			Value: proto.String(value),
+		}
+		scraped[name] = newPair
+		metric.Label = append(metric.Label, newPair)
+	}
+	sort.Slice(metric.Label, func(i, j int) bool {
+		return metric.Label[i].GetName() < metric.Label[j].GetName()
+	})
+}
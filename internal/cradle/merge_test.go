@@ -0,0 +1,148 @@
+package cradle
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMergeSameFamily(t *testing.T) {
+	merger := newMetricMerger()
+	merger.add("a", &TargetConfig{Name: "a"}, [][]byte{[]byte(`### Scraping Target
+### URL: http://localhost:9999/metrics
+# HELP answer Answer To Everything
+# TYPE answer gauge
+answer{scope="universe"} 42
+`), []byte(`### Scraping Target
+### URL: http://localhost:9998/metrics
+# HELP answer Answer To Everything
+# TYPE answer gauge
+answer{scope="world"} 41
+`)})
+	merger.add("b", &TargetConfig{Name: "b"}, [][]byte{[]byte(`# HELP answer Answer To Everything
+# TYPE answer gauge
+answer{scope="galaxy"} 43
+`)})
+	var out bytes.Buffer
+	if err := merger.writeTo(&out); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	result := out.String()
+	if n := strings.Count(result, "# TYPE answer gauge\n"); n != 1 {
+		t.Errorf("TYPE line must appear exactly once, but appeared %d times:\n%s", n, result)
+	}
+	for _, sample := range []string{
+		`answer{cradle_target="a",scope="universe"} 42`,
+		`answer{cradle_target="a",scope="world"} 41`,
+		`answer{cradle_target="b",scope="galaxy"} 43`,
+	} {
+		if !strings.Contains(result, sample) {
+			t.Errorf("Sample %s not found:\n%s", sample, result)
+		}
+	}
+	if strings.Contains(result, "cradle_probe_type_conflict") {
+		t.Errorf("Unexpected conflict:\n%s", result)
+	}
+}
+
+func TestMergeTypeConflict(t *testing.T) {
+	merger := newMetricMerger()
+	merger.add("a", &TargetConfig{Name: "a"}, [][]byte{[]byte(`# TYPE answer gauge
+answer 42
+`)})
+	merger.add("b", &TargetConfig{Name: "b"}, [][]byte{[]byte(`# TYPE answer counter
+answer 43
+`)})
+	var out bytes.Buffer
+	if err := merger.writeTo(&out); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	result := out.String()
+	if strings.Contains(result, `answer{cradle_target="b"} 43`) {
+		t.Errorf("Conflicting sample must be dropped:\n%s", result)
+	}
+	expected := `cradle_probe_type_conflict{family="answer",target="b",type="counter"} 1`
+	if !strings.Contains(result, expected) {
+		t.Errorf("Conflict not reported:\n%s", result)
+	}
+}
+
+func TestMergeTargetLabels(t *testing.T) {
+	const output = `# TYPE answer gauge
+answer{env="dev",scope="universe"} 42
+`
+	merger := newMetricMerger()
+	merger.add("a", &TargetConfig{
+		Name:   "a",
+		Labels: map[string]string{"env": "prod"},
+	}, [][]byte{[]byte(output)})
+	merger.add("b", &TargetConfig{
+		Name:        "b",
+		Labels:      map[string]string{"env": "prod"},
+		HonorLabels: true,
+	}, [][]byte{[]byte(output)})
+	var out bytes.Buffer
+	if err := merger.writeTo(&out); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	result := out.String()
+	expected := []string{
+		`answer{cradle_target="a",env="prod",exported_env="dev",scope="universe"} 42`,
+		`answer{cradle_target="b",env="dev",scope="universe"} 42`,
+	}
+	for _, sample := range expected {
+		if !strings.Contains(result, sample) {
+			t.Errorf("Sample %s not found:\n%s", sample, result)
+		}
+	}
+}
+
+func TestMergeSectionBoundaries(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.prom")
+	second := filepath.Join(dir, "second.prom")
+	// A line looking like a banner must not split the output of the file.
+	if err := ioutil.WriteFile(first, []byte("# HELP answer Answer\n# TYPE answer gauge\nanswer 1\n### Not A Target\nanswer{scope=\"world\"} 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(second, []byte("# HELP answer Answer\n# TYPE answer gauge\nanswer{scope=\"galaxy\"} 3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	target := &StaticFileTarget{
+		Config: &TargetConfig{
+			Name:         "static",
+			StaticConfig: &StaticFileConfig{Paths: []string{first, second}},
+		},
+	}
+	result := scrapeTarget(context.Background(), "static", target)
+	if result.err != nil {
+		t.Fatalf("Failed to scrape: %v", result.err)
+	}
+	if len(result.sections) != 2 {
+		t.Fatalf("Each file must be a section, but got %d sections", len(result.sections))
+	}
+	merger := newMetricMerger()
+	if _, err := merger.add("static", target.Config, result.sections); err != nil {
+		t.Fatalf("Failed to merge: %v", err)
+	}
+	var out bytes.Buffer
+	if err := merger.writeTo(&out); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	output := out.String()
+	if strings.Contains(output, "cradle_probe_type_conflict") {
+		t.Errorf("Unexpected conflict:\n%s", output)
+	}
+	for _, sample := range []string{
+		`answer{cradle_target="static"} 1`,
+		`answer{cradle_target="static",scope="world"} 2`,
+		`answer{cradle_target="static",scope="galaxy"} 3`,
+	} {
+		if !strings.Contains(output, sample) {
+			t.Errorf("Sample %s not found:\n%s", sample, output)
+		}
+	}
+}
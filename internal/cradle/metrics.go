@@ -0,0 +1,184 @@
+package cradle
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "cradle"
+
+// collector exposes the internals of cradle itself on the metric path.
+type collector struct {
+	cradle *Cradle
+
+	targets *prometheus.Desc
+
+	configReloads              *prometheus.CounterVec
+	configLastReloadSuccessful prometheus.Gauge
+
+	daemonRestarts     *prometheus.CounterVec
+	daemonState        *prometheus.Desc
+	daemonLastExitCode *prometheus.Desc
+
+	cronJobRuns     *prometheus.CounterVec
+	cronJobFailures *prometheus.CounterVec
+	cronJobDuration *prometheus.HistogramVec
+
+	probeRequests prometheus.Counter
+	probeDuration prometheus.Histogram
+
+	targetTruncations *prometheus.CounterVec
+}
+
+func newCollector(cradle *Cradle) *collector {
+	return &collector{
+		cradle: cradle,
+		targets: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "targets"),
+			"Number of loaded targets by type.",
+			[]string{"type"}, nil),
+		configReloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "config",
+			Name:      "reloads_total",
+			Help:      "Number of config reloads by result.",
+		}, []string{"result"}),
+		configLastReloadSuccessful: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "config",
+			Name:      "last_reload_success_timestamp_seconds",
+			Help:      "Unix time of the last successful config reload.",
+		}),
+		daemonRestarts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "daemon",
+			Name:      "restarts_total",
+			Help:      "Number of times a service daemon was restarted, by the reason; exited or liveness.",
+		}, []string{"target", "reason"}),
+		daemonState: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "daemon", "state"),
+			"Current state of a service daemon; 1 for the current state, 0 for the others.",
+			[]string{"target", "state"}, nil),
+		daemonLastExitCode: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "daemon", "last_exit_code"),
+			"Exit code of the last run of a service daemon; -1 if killed by a signal or failed to start.",
+			[]string{"target"}, nil),
+		cronJobRuns: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "cron_job",
+			Name:      "runs_total",
+			Help:      "Number of scheduled cron job runs.",
+		}, []string{"target"}),
+		cronJobFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "cron_job",
+			Name:      "failures_total",
+			Help:      "Number of scheduled cron job runs which failed.",
+		}, []string{"target"}),
+		cronJobDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "cron_job",
+			Name:      "duration_seconds",
+			Help:      "Duration of scheduled cron job runs.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"target"}),
+		probeRequests: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "probe",
+			Name:      "requests_total",
+			Help:      "Number of requests to the probe path.",
+		}),
+		probeDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "probe",
+			Name:      "duration_seconds",
+			Help:      "Duration of requests to the probe path.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		targetTruncations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "target",
+			Name:      "body_size_limit_exceeded_total",
+			Help:      "Number of times the output of a target was truncated by body_size_limit.",
+		}, []string{"target"}),
+	}
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.targets
+	c.configReloads.Describe(ch)
+	c.configLastReloadSuccessful.Describe(ch)
+	c.daemonRestarts.Describe(ch)
+	ch <- c.daemonState
+	ch <- c.daemonLastExitCode
+	c.cronJobRuns.Describe(ch)
+	c.cronJobFailures.Describe(ch)
+	c.cronJobDuration.Describe(ch)
+	c.probeRequests.Describe(ch)
+	c.probeDuration.Describe(ch)
+	c.targetTruncations.Describe(ch)
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	counts := make(map[string]int)
+	for _, typ := range targetTypes {
+		counts[typ] = 0
+	}
+	for name, target := range c.cradle.Targets() {
+		counts[targetType(target)]++
+		if daemon, ok := target.(*ServiceTarget); ok {
+			status := daemon.Status()
+			for _, state := range daemonStates {
+				value := 0.0
+				if state == status.State {
+					value = 1.0
+				}
+				ch <- prometheus.MustNewConstMetric(c.daemonState, prometheus.GaugeValue, value, name, string(state))
+			}
+			ch <- prometheus.MustNewConstMetric(c.daemonLastExitCode, prometheus.GaugeValue, float64(status.LastExitCode), name)
+		}
+	}
+	for typ, count := range counts {
+		ch <- prometheus.MustNewConstMetric(c.targets, prometheus.GaugeValue, float64(count), typ)
+	}
+	c.configReloads.Collect(ch)
+	c.configLastReloadSuccessful.Collect(ch)
+	c.daemonRestarts.Collect(ch)
+	c.cronJobRuns.Collect(ch)
+	c.cronJobFailures.Collect(ch)
+	c.cronJobDuration.Collect(ch)
+	c.probeRequests.Collect(ch)
+	c.probeDuration.Collect(ch)
+	c.targetTruncations.Collect(ch)
+}
+
+func (c *collector) observeReload(err error) {
+	if err != nil {
+		c.configReloads.WithLabelValues("failure").Inc()
+		return
+	}
+	c.configReloads.WithLabelValues("success").Inc()
+	c.configLastReloadSuccessful.SetToCurrentTime()
+}
+
+func (c *collector) observeDaemonRestart(name string, reason string) {
+	c.daemonRestarts.WithLabelValues(name, reason).Inc()
+}
+
+func (c *collector) observeCronJobRun(name string, duration time.Duration, err error) {
+	c.cronJobRuns.WithLabelValues(name).Inc()
+	if err != nil {
+		c.cronJobFailures.WithLabelValues(name).Inc()
+	}
+	c.cronJobDuration.WithLabelValues(name).Observe(duration.Seconds())
+}
+
+func (c *collector) observeTruncation(name string) {
+	c.targetTruncations.WithLabelValues(name).Inc()
+}
+
+func (c *collector) observeProbe(duration time.Duration) {
+	c.probeRequests.Inc()
+	c.probeDuration.Observe(duration.Seconds())
+}
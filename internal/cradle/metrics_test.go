@@ -0,0 +1,115 @@
+package cradle
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// waitFor polls cond until it holds, or fails the test after the timeout.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCollector(t *testing.T) {
+	cradle, config := newTestCradle(t, map[string]string{
+		"static.yml":   "static: {paths: []}\n",
+		"exporter.yml": "exporter: {endpoints: ['http://127.0.0.1:1/metrics']}\n",
+		"script.yml":   "script: {path: '/bin/true'}\n",
+		"cron.yml":     "cron: {path: '/bin/false', every: '@every 1s'}\n",
+		"daemon.yml": `service:
+  path: '/bin/sh'
+  args: ['-c', 'exit 3']
+  restart: {initial_backoff: '10ms', max_backoff: '10ms', max_restarts: 2, window: '1m'}
+`,
+	})
+	c := cradle.metrics
+
+	if err := testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP cradle_targets Number of loaded targets by type.
+# TYPE cradle_targets gauge
+cradle_targets{type="cron"} 1
+cradle_targets{type="exporter"} 1
+cradle_targets{type="script"} 1
+cradle_targets{type="service"} 1
+cradle_targets{type="static"} 1
+`), "cradle_targets"); err != nil {
+		t.Error(err)
+	}
+
+	// The second reload fails with a broken target config, and keeps the targets.
+	if err := cradle.Reload(config); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(config.IncludeDirs[0], "broken.yml"), []byte("static: [\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cradle.Reload(config); err == nil {
+		t.Fatal("Broken config must not be loaded")
+	}
+	// Failing to read the main config file on SIGHUP counts as well.
+	if err := cradle.ReloadFrom(func() (*Config, error) {
+		return nil, errors.New("broken main config")
+	}); err == nil {
+		t.Fatal("Failure to read config must be returned")
+	}
+	if err := testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP cradle_config_reloads_total Number of config reloads by result.
+# TYPE cradle_config_reloads_total counter
+cradle_config_reloads_total{result="failure"} 2
+cradle_config_reloads_total{result="success"} 2
+`), "cradle_config_reloads_total"); err != nil {
+		t.Error(err)
+	}
+	if len(cradle.Targets()) != 5 {
+		t.Errorf("Targets must be kept on a failed reload: %v", cradle.Targets())
+	}
+	if testutil.ToFloat64(c.configLastReloadSuccessful) <= 0 {
+		t.Error("Last successful reload must be recorded")
+	}
+
+	// The daemon exits at once, so it is restarted until it gives up.
+	daemon := cradle.Targets()["daemon"].(*ServiceTarget)
+	waitFor(t, 10*time.Second, "the daemon to fail", func() bool {
+		return daemon.Status().State == DaemonFailed
+	})
+	if err := testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP cradle_daemon_restarts_total Number of times a service daemon was restarted, by the reason; exited or liveness.
+# TYPE cradle_daemon_restarts_total counter
+cradle_daemon_restarts_total{reason="exited",target="daemon"} 2
+# HELP cradle_daemon_last_exit_code Exit code of the last run of a service daemon; -1 if killed by a signal or failed to start.
+# TYPE cradle_daemon_last_exit_code gauge
+cradle_daemon_last_exit_code{target="daemon"} 3
+# HELP cradle_daemon_state Current state of a service daemon; 1 for the current state, 0 for the others.
+# TYPE cradle_daemon_state gauge
+cradle_daemon_state{state="backoff",target="daemon"} 0
+cradle_daemon_state{state="failed",target="daemon"} 1
+cradle_daemon_state{state="ready",target="daemon"} 0
+cradle_daemon_state{state="running",target="daemon"} 0
+cradle_daemon_state{state="starting",target="daemon"} 0
+cradle_daemon_state{state="stopped",target="daemon"} 0
+cradle_daemon_state{state="unhealthy",target="daemon"} 0
+`), "cradle_daemon_restarts_total", "cradle_daemon_last_exit_code", "cradle_daemon_state"); err != nil {
+		t.Error(err)
+	}
+
+	// The cron job fails every time it runs.
+	waitFor(t, 5*time.Second, "the cron job to run", func() bool {
+		return testutil.ToFloat64(c.cronJobRuns.WithLabelValues("cron")) >= 1
+	})
+	runs := testutil.ToFloat64(c.cronJobRuns.WithLabelValues("cron"))
+	if failures := testutil.ToFloat64(c.cronJobFailures.WithLabelValues("cron")); failures != runs {
+		t.Errorf("Every run of the cron job must fail: %v runs, %v failures", runs, failures)
+	}
+}
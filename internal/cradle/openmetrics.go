@@ -0,0 +1,623 @@
+package cradle
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+// openMetricsBanner is written by scrapeEndpoint before a body in the OpenMetrics text format.
+const openMetricsBanner = "### Format: OpenMetrics"
+
+// acceptHeader asks endpoints for OpenMetrics, to keep units, _created series and exemplars.
+const acceptHeader = expfmt.OpenMetricsType + `; version=` + expfmt.OpenMetricsVersion + `,text/plain;version=0.0.4;q=0.5,*/*;q=0.1`
+
+// openMetricsMeta keeps what dto.MetricFamily cannot hold.
+type openMetricsMeta struct {
+	// units by the name of the metric family.
+	units map[string]string
+	// created is the value of the _created series of each metric.
+	created map[*dto.Metric]float64
+	// types are the OpenMetrics types by the name of the metric family, for the ones dto.MetricType cannot tell;
+	// info and stateset are kept as gauges, and gaugehistogram as a histogram.
+	types map[string]string
+}
+
+// openMetricsSuffixes are the suffixes of the samples which belong to a metric family of each type.
+var openMetricsSuffixes = map[string][]string{
+	"counter":        {"_total", "_created"},
+	"gauge":          {""},
+	"stateset":       {""},
+	"unknown":        {""},
+	"info":           {"_info"},
+	"histogram":      {"_bucket", "_count", "_sum", "_created"},
+	"gaugehistogram": {"_bucket", "_gcount", "_gsum"},
+	"summary":        {"", "_count", "_sum", "_created"},
+}
+
+// isOpenMetrics tells whether a section of the output of a target is in the OpenMetrics text format;
+// marked by openMetricsBanner, or ended with "# EOF".
+func isOpenMetrics(section []byte) bool {
+	lines := bytes.Split(bytes.TrimRight(section, "\n"), []byte("\n"))
+	for _, line := range lines {
+		if string(line) == openMetricsBanner {
+			return true
+		}
+	}
+	return string(lines[len(lines)-1]) == "# EOF"
+}
+
+// openMetricsFamily is a metric family being parsed.
+type openMetricsFamily struct {
+	// name is the name of the family in OpenMetrics, without the suffixes of the samples.
+	name    string
+	typ     string
+	unit    string
+	family  *dto.MetricFamily
+	metrics map[string]*dto.Metric
+}
+
+func (f *openMetricsFamily) setType(typ string) error {
+	if len(f.family.Metric) > 0 {
+		return fmt.Errorf("TYPE of %s after its samples", f.name)
+	}
+	name := f.name
+	switch typ {
+	case "counter":
+		f.family.Type = dto.MetricType_COUNTER.Enum()
+		name += "_total"
+	case "gauge", "stateset":
+		f.family.Type = dto.MetricType_GAUGE.Enum()
+	case "info":
+		f.family.Type = dto.MetricType_GAUGE.Enum()
+		name += "_info"
+	case "histogram", "gaugehistogram":
+		// gaugehistogram has no counterpart in the classic format; it is written back by its samples, see gaugeHistogramFamilies.
+		f.family.Type = dto.MetricType_HISTOGRAM.Enum()
+	case "summary":
+		f.family.Type = dto.MetricType_SUMMARY.Enum()
+	case "unknown":
+		f.family.Type = dto.MetricType_UNTYPED.Enum()
+	default:
+		return fmt.Errorf("unknown TYPE of %s: %s", f.name, typ)
+	}
+	f.typ = typ
+	f.family.Name = proto.String(name)
+	return nil
+}
+
+// metric returns the metric with the labels, added to the family if it is new.
+func (f *openMetricsFamily) metric(labels []*dto.LabelPair) *dto.Metric {
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].GetName() < labels[j].GetName()
+	})
+	var key strings.Builder
+	for _, pair := range labels {
+		key.WriteString(pair.GetName())
+		key.WriteByte(0xff)
+		key.WriteString(pair.GetValue())
+		key.WriteByte(0xff)
+	}
+	metric, ok := f.metrics[key.String()]
+	if !ok {
+		metric = &dto.Metric{Label: labels}
+		f.metrics[key.String()] = metric
+		f.family.Metric = append(f.family.Metric, metric)
+	}
+	return metric
+}
+
+// openMetricsParser parses the OpenMetrics text format into metric families like expfmt.TextParser does,
+// keeping units, _created series and exemplars.
+type openMetricsParser struct {
+	families map[string]*openMetricsFamily
+	current  *openMetricsFamily
+	meta     *openMetricsMeta
+}
+
+// parseOpenMetrics parses the output of a target in the OpenMetrics text format.
+// Lines starting with "#" other than HELP, TYPE and UNIT are skipped, like banners of cradle.
+func parseOpenMetrics(in []byte) (map[string]*dto.MetricFamily, *openMetricsMeta, error) {
+	p := &openMetricsParser{
+		families: make(map[string]*openMetricsFamily),
+		meta: &openMetricsMeta{
+			units:   make(map[string]string),
+			created: make(map[*dto.Metric]float64),
+			types:   make(map[string]string),
+		},
+	}
+	for idx, line := range strings.Split(string(in), "\n") {
+		if line == "# EOF" {
+			break
+		}
+		if err := p.parseLine(line); err != nil {
+			return nil, nil, fmt.Errorf("line %d: %v", idx+1, err)
+		}
+	}
+	families := make(map[string]*dto.MetricFamily, len(p.families))
+	for _, f := range p.families {
+		// Drop metrics which have only _created series, and families without metrics.
+		metrics := f.family.Metric[:0]
+		for _, metric := range f.family.Metric {
+			if metric.Counter != nil || metric.Gauge != nil || metric.Untyped != nil || metric.Histogram != nil || metric.Summary != nil {
+				metrics = append(metrics, metric)
+			}
+		}
+		f.family.Metric = metrics
+		if len(metrics) == 0 {
+			continue
+		}
+		families[f.family.GetName()] = f.family
+		if len(f.unit) > 0 {
+			p.meta.units[f.family.GetName()] = f.unit
+		}
+		switch f.typ {
+		case "info", "stateset", "gaugehistogram":
+			p.meta.types[f.family.GetName()] = f.typ
+		}
+	}
+	return families, p.meta, nil
+}
+
+func (p *openMetricsParser) family(name string) *openMetricsFamily {
+	f, ok := p.families[name]
+	if !ok {
+		f = &openMetricsFamily{
+			name: name,
+			typ:  "unknown",
+			family: &dto.MetricFamily{
+				Name: proto.String(name),
+				Type: dto.MetricType_UNTYPED.Enum(),
+			},
+			metrics: make(map[string]*dto.Metric),
+		}
+		p.families[name] = f
+	}
+	return f
+}
+
+func (p *openMetricsParser) parseLine(line string) error {
+	if len(line) == 0 {
+		return nil
+	}
+	if strings.HasPrefix(line, "#") {
+		fields := strings.SplitN(line, " ", 4)
+		if len(fields) < 3 || fields[0] != "#" {
+			return nil
+		}
+		arg := ""
+		if len(fields) == 4 {
+			arg = fields[3]
+		}
+		switch fields[1] {
+		case "TYPE", "HELP", "UNIT":
+			if !model.IsValidMetricName(model.LabelValue(fields[2])) {
+				return fmt.Errorf("invalid metric name in %s: %q", fields[1], fields[2])
+			}
+		}
+		switch fields[1] {
+		case "TYPE":
+			p.current = p.family(fields[2])
+			return p.current.setType(arg)
+		case "HELP":
+			p.current = p.family(fields[2])
+			p.current.family.Help = proto.String(unescapeOpenMetrics(arg))
+		case "UNIT":
+			p.current = p.family(fields[2])
+			p.current.unit = arg
+		}
+		return nil
+	}
+	sample, err := parseOpenMetricsSample(line)
+	if err != nil {
+		return err
+	}
+	f, suffix, err := p.resolve(sample.name)
+	if err != nil {
+		return err
+	}
+	labels := sample.labels
+	var bound float64
+	boundLabel := ""
+	switch {
+	case (f.typ == "histogram" || f.typ == "gaugehistogram") && suffix == "_bucket":
+		boundLabel = "le"
+	case f.typ == "summary" && suffix == "":
+		boundLabel = "quantile"
+	}
+	if len(boundLabel) > 0 {
+		found := false
+		labels = make([]*dto.LabelPair, 0, len(sample.labels))
+		for _, pair := range sample.labels {
+			if pair.GetName() != boundLabel {
+				labels = append(labels, pair)
+				continue
+			}
+			bound, err = strconv.ParseFloat(pair.GetValue(), 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s of %s: %v", boundLabel, sample.name, err)
+			}
+			found = true
+		}
+		if !found {
+			return fmt.Errorf("%s has no %s label", sample.name, boundLabel)
+		}
+	}
+	metric := f.metric(labels)
+	if sample.timestamp != nil && metric.TimestampMs == nil {
+		metric.TimestampMs = proto.Int64(int64(math.Round(*sample.timestamp * 1000)))
+	}
+	value := sample.value
+	if suffix == "_created" {
+		p.meta.created[metric] = value
+		return nil
+	}
+	switch f.typ {
+	case "counter":
+		metric.Counter = &dto.Counter{Value: &value, Exemplar: sample.exemplar}
+	case "gauge", "stateset", "info":
+		metric.Gauge = &dto.Gauge{Value: &value}
+	case "unknown":
+		metric.Untyped = &dto.Untyped{Value: &value}
+	case "histogram", "gaugehistogram":
+		if metric.Histogram == nil {
+			metric.Histogram = &dto.Histogram{}
+		}
+		switch suffix {
+		case "_bucket":
+			metric.Histogram.Bucket = append(metric.Histogram.Bucket, &dto.Bucket{
+				CumulativeCount: proto.Uint64(uint64(value)),
+				UpperBound:      proto.Float64(bound),
+				Exemplar:        sample.exemplar,
+			})
+		case "_count", "_gcount":
+			metric.Histogram.SampleCount = proto.Uint64(uint64(value))
+		case "_sum", "_gsum":
+			metric.Histogram.SampleSum = &value
+		}
+	case "summary":
+		if metric.Summary == nil {
+			metric.Summary = &dto.Summary{}
+		}
+		switch suffix {
+		case "":
+			metric.Summary.Quantile = append(metric.Summary.Quantile, &dto.Quantile{
+				Quantile: proto.Float64(bound),
+				Value:    &value,
+			})
+		case "_count":
+			metric.Summary.SampleCount = proto.Uint64(uint64(value))
+		case "_sum":
+			metric.Summary.SampleSum = &value
+		}
+	}
+	return nil
+}
+
+// resolve finds the family which the sample of the name belongs to, and the suffix of the sample.
+// Samples not belonging to the current family make a family of unknown type on their own.
+func (p *openMetricsParser) resolve(name string) (*openMetricsFamily, string, error) {
+	if f := p.current; f != nil && strings.HasPrefix(name, f.name) {
+		suffix := name[len(f.name):]
+		for _, s := range openMetricsSuffixes[f.typ] {
+			if suffix == s {
+				return f, suffix, nil
+			}
+		}
+	}
+	f := p.family(name)
+	p.current = f
+	for _, s := range openMetricsSuffixes[f.typ] {
+		if s == "" {
+			return f, "", nil
+		}
+	}
+	return nil, "", fmt.Errorf("unexpected sample of %s %s: %s", f.typ, f.name, name)
+}
+
+type openMetricsSample struct {
+	name      string
+	labels    []*dto.LabelPair
+	value     float64
+	timestamp *float64
+	exemplar  *dto.Exemplar
+}
+
+// parseOpenMetricsSample parses a line like `name{label="value"} 1.0 1600000000.0 # {trace_id="abc"} 0.5`.
+func parseOpenMetricsSample(line string) (*openMetricsSample, error) {
+	end := strings.IndexAny(line, "{ ")
+	if end <= 0 {
+		return nil, fmt.Errorf("invalid sample: %q", line)
+	}
+	sample := &openMetricsSample{name: line[:end]}
+	if !model.IsValidMetricName(model.LabelValue(sample.name)) {
+		return nil, fmt.Errorf("invalid metric name: %q", sample.name)
+	}
+	rest := line[end:]
+	var err error
+	if strings.HasPrefix(rest, "{") {
+		sample.labels, rest, err = parseOpenMetricsLabels(rest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid labels of %s: %v", sample.name, err)
+		}
+	}
+	exemplar := ""
+	if idx := strings.Index(rest, " # "); idx >= 0 {
+		rest, exemplar = rest[:idx], rest[idx+3:]
+	}
+	fields := strings.Fields(rest)
+	if len(fields) < 1 || len(fields) > 2 {
+		return nil, fmt.Errorf("invalid sample: %q", line)
+	}
+	if sample.value, err = strconv.ParseFloat(fields[0], 64); err != nil {
+		return nil, fmt.Errorf("invalid value of %s: %v", sample.name, err)
+	}
+	if len(fields) == 2 {
+		timestamp, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp of %s: %v", sample.name, err)
+		}
+		sample.timestamp = &timestamp
+	}
+	if len(exemplar) > 0 {
+		if sample.exemplar, err = parseOpenMetricsExemplar(exemplar); err != nil {
+			return nil, fmt.Errorf("invalid exemplar of %s: %v", sample.name, err)
+		}
+	}
+	return sample, nil
+}
+
+// parseOpenMetricsExemplar parses an exemplar like `{trace_id="abc"} 0.5 1600000000.0`.
+func parseOpenMetricsExemplar(s string) (*dto.Exemplar, error) {
+	if !strings.HasPrefix(s, "{") {
+		return nil, fmt.Errorf("no labels: %q", s)
+	}
+	labels, rest, err := parseOpenMetricsLabels(s)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(rest)
+	if len(fields) < 1 || len(fields) > 2 {
+		return nil, fmt.Errorf("invalid exemplar: %q", s)
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil, err
+	}
+	exemplar := &dto.Exemplar{Label: labels, Value: &value}
+	if len(fields) == 2 {
+		seconds, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, err
+		}
+		if exemplar.Timestamp, err = ptypes.TimestampProto(time.Unix(0, int64(seconds*1e9))); err != nil {
+			return nil, err
+		}
+	}
+	return exemplar, nil
+}
+
+// parseOpenMetricsLabels parses labels like `{a="1",b="2"}` at the beginning of s, and returns the rest of s.
+// Invalid or duplicate label names are rejected, not to pass them into the merged output.
+func parseOpenMetricsLabels(s string) ([]*dto.LabelPair, string, error) {
+	labels := make([]*dto.LabelPair, 0)
+	seen := make(map[string]bool)
+	pos := 1
+	for {
+		if pos >= len(s) {
+			return nil, "", fmt.Errorf("unterminated labels: %q", s)
+		}
+		if s[pos] == '}' {
+			return labels, s[pos+1:], nil
+		}
+		eq := strings.IndexByte(s[pos:], '=')
+		if eq <= 0 {
+			return nil, "", fmt.Errorf("invalid labels: %q", s)
+		}
+		name := s[pos : pos+eq]
+		if !model.LabelName(name).IsValid() {
+			return nil, "", fmt.Errorf("invalid label name %q: %q", name, s)
+		}
+		if seen[name] {
+			return nil, "", fmt.Errorf("duplicate label %s: %q", name, s)
+		}
+		seen[name] = true
+		pos += eq + 1
+		if pos >= len(s) || s[pos] != '"' {
+			return nil, "", fmt.Errorf("unquoted value of %s: %q", name, s)
+		}
+		var value strings.Builder
+		for pos++; pos < len(s) && s[pos] != '"'; pos++ {
+			c := s[pos]
+			if c == '\\' && pos+1 < len(s) {
+				pos++
+				switch s[pos] {
+				case 'n':
+					c = '\n'
+				case '\\', '"':
+					c = s[pos]
+				default:
+					return nil, "", fmt.Errorf("invalid escape in value of %s: %q", name, s)
+				}
+			}
+			value.WriteByte(c)
+		}
+		if pos >= len(s) {
+			return nil, "", fmt.Errorf("unterminated value of %s: %q", name, s)
+		}
+		pos++
+		labels = append(labels, &dto.LabelPair{
+			Name:  proto.String(name),
+			Value: proto.String(value.String()),
+		})
+		if pos < len(s) && s[pos] == ',' {
+			pos++
+		} else if pos < len(s) && s[pos] != '}' {
+			return nil, "", fmt.Errorf("no comma after the value of %s: %q", name, s)
+		}
+	}
+}
+
+var openMetricsUnescaper = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\"`, `"`)
+
+func unescapeOpenMetrics(s string) string {
+	return openMetricsUnescaper.Replace(s)
+}
+
+// writeOpenMetricsFamily writes the family in the OpenMetrics text format by expfmt.MetricFamilyToOpenMetrics,
+// adding the UNIT line and _created series which it does not support, and restoring the OpenMetrics type typ if any.
+func writeOpenMetricsFamily(w io.Writer, family *dto.MetricFamily, typ string, unit string, created map[*dto.Metric]float64) error {
+	hasCreated := false
+	for _, metric := range family.Metric {
+		if _, ok := created[metric]; ok {
+			hasCreated = true
+			break
+		}
+	}
+	if len(unit) == 0 && !hasCreated {
+		if len(typ) == 0 {
+			_, err := expfmt.MetricFamilyToOpenMetrics(w, family)
+			return err
+		}
+		var buff bytes.Buffer
+		if _, err := expfmt.MetricFamilyToOpenMetrics(&buff, family); err != nil {
+			return err
+		}
+		_, err := w.Write(restoreOpenMetricsType(buff.Bytes(), family.GetName(), typ))
+		return err
+	}
+	name := family.GetName()
+	if family.GetType() == dto.MetricType_COUNTER {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	var buff bytes.Buffer
+	if _, err := expfmt.MetricFamilyToOpenMetrics(&buff, &dto.MetricFamily{
+		Name: family.Name,
+		Help: family.Help,
+		Type: family.Type,
+	}); err != nil {
+		return err
+	}
+	// OpenMetrics requires the name of the family to end with its unit.
+	if len(unit) > 0 && strings.HasSuffix(name, "_"+unit) {
+		buff.WriteString("# UNIT " + name + " " + unit + "\n")
+	}
+	// Without HELP, the header is the TYPE line only; it is dropped from each metric written below.
+	single := &dto.MetricFamily{Name: family.Name, Type: family.Type}
+	for _, metric := range family.Metric {
+		single.Metric = []*dto.Metric{metric}
+		if err := writeOpenMetricsSamples(&buff, single); err != nil {
+			return err
+		}
+		value, ok := created[metric]
+		if !ok {
+			continue
+		}
+		if err := writeOpenMetricsSamples(&buff, &dto.MetricFamily{
+			Name: proto.String(name + "_created"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{
+				Label: metric.Label,
+				Gauge: &dto.Gauge{Value: proto.Float64(value)},
+			}},
+		}); err != nil {
+			return err
+		}
+	}
+	if len(typ) > 0 {
+		_, err := w.Write(restoreOpenMetricsType(buff.Bytes(), family.GetName(), typ))
+		return err
+	}
+	_, err := buff.WriteTo(w)
+	return err
+}
+
+// restoreOpenMetricsType rewrites the family of the name written by expfmt.MetricFamilyToOpenMetrics into the OpenMetrics type typ;
+// the name of an info family loses its _info suffix, and _count and _sum of a gaugehistogram become _gcount and _gsum.
+func restoreOpenMetricsType(out []byte, name string, typ string) []byte {
+	familyName := name
+	if typ == "info" {
+		familyName = strings.TrimSuffix(name, "_info")
+	}
+	lines := strings.SplitAfter(string(out), "\n")
+	for idx, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "# TYPE "+name+" "):
+			lines[idx] = "# TYPE " + familyName + " " + typ + "\n"
+		case strings.HasPrefix(line, "# HELP "+name+" "):
+			lines[idx] = "# HELP " + familyName + line[len("# HELP "+name):]
+		case typ == "gaugehistogram":
+			for suffix, gauge := range map[string]string{"_count": "_gcount", "_sum": "_gsum"} {
+				if rest := strings.TrimPrefix(line, name+suffix); len(rest) < len(line) && (rest[0] == '{' || rest[0] == ' ') {
+					lines[idx] = name + gauge + rest
+				}
+			}
+		}
+	}
+	return []byte(strings.Join(lines, ""))
+}
+
+// gaugeHistogramFamilies splits a gaugehistogram kept as a histogram family into unknown families of its samples,
+// because the classic text format has no type for it.
+func gaugeHistogramFamilies(family *dto.MetricFamily) []*dto.MetricFamily {
+	name := family.GetName()
+	bucket := &dto.MetricFamily{Name: proto.String(name + "_bucket"), Help: family.Help, Type: dto.MetricType_UNTYPED.Enum()}
+	gcount := &dto.MetricFamily{Name: proto.String(name + "_gcount"), Help: family.Help, Type: dto.MetricType_UNTYPED.Enum()}
+	gsum := &dto.MetricFamily{Name: proto.String(name + "_gsum"), Help: family.Help, Type: dto.MetricType_UNTYPED.Enum()}
+	for _, metric := range family.Metric {
+		histogram := metric.GetHistogram()
+		for _, b := range histogram.GetBucket() {
+			bucket.Metric = append(bucket.Metric, &dto.Metric{
+				Label: append(append([]*dto.LabelPair{}, metric.Label...), &dto.LabelPair{
+					Name:  proto.String(model.BucketLabel),
+					Value: proto.String(strconv.FormatFloat(b.GetUpperBound(), 'g', -1, 64)),
+				}),
+				Untyped:     &dto.Untyped{Value: proto.Float64(float64(b.GetCumulativeCount()))},
+				TimestampMs: metric.TimestampMs,
+			})
+		}
+		if histogram.SampleCount != nil {
+			gcount.Metric = append(gcount.Metric, &dto.Metric{
+				Label:       metric.Label,
+				Untyped:     &dto.Untyped{Value: proto.Float64(float64(histogram.GetSampleCount()))},
+				TimestampMs: metric.TimestampMs,
+			})
+		}
+		if histogram.SampleSum != nil {
+			gsum.Metric = append(gsum.Metric, &dto.Metric{
+				Label:       metric.Label,
+				Untyped:     &dto.Untyped{Value: histogram.SampleSum},
+				TimestampMs: metric.TimestampMs,
+			})
+		}
+	}
+	families := make([]*dto.MetricFamily, 0, 3)
+	for _, f := range []*dto.MetricFamily{bucket, gcount, gsum} {
+		if len(f.Metric) > 0 {
+			families = append(families, f)
+		}
+	}
+	return families
+}
+
+// writeOpenMetricsSamples writes the samples of the family without HELP, dropping its TYPE line.
+func writeOpenMetricsSamples(buff *bytes.Buffer, family *dto.MetricFamily) error {
+	var out bytes.Buffer
+	if _, err := expfmt.MetricFamilyToOpenMetrics(&out, family); err != nil {
+		return err
+	}
+	samples := out.Bytes()
+	_, _ = buff.Write(samples[bytes.IndexByte(samples, '\n')+1:])
+	return nil
+}
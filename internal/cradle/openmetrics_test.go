@@ -0,0 +1,176 @@
+package cradle
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const openMetricsOutput = `### Scraping Target
+### URL: http://localhost:9999/metrics
+### Format: OpenMetrics
+# TYPE requests counter
+# UNIT requests bytes
+# HELP requests Requests \"served\".
+requests_total{path="/a\"b"} 10.0 # {trace_id="abc"} 1.0 1600000000.5
+requests_created{path="/a\"b"} 1600000000.0
+# TYPE latency_seconds histogram
+# UNIT latency_seconds seconds
+latency_seconds_bucket{le="0.5"} 3.0 # {trace_id="def"} 0.25
+latency_seconds_bucket{le="+Inf"} 5.0
+latency_seconds_count 5.0
+latency_seconds_sum 3.5
+latency_seconds_created 1600000000.0
+# TYPE build info
+build_info{version="1.0"} 1.0
+# TYPE size summary
+size{quantile="0.5"} 7.0
+size_count 2.0
+size_sum 14.0
+# TYPE queue gaugehistogram
+queue_bucket{le="+Inf"} 4.0
+queue_gcount 4.0
+queue_gsum 2.5
+# TYPE door stateset
+door{door="open"} 1.0
+door{door="closed"} 0.0
+# EOF
+`
+
+func TestParseOpenMetrics(t *testing.T) {
+	families, meta, err := parseOpenMetrics([]byte(openMetricsOutput))
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	requests := families["requests_total"]
+	if requests == nil || len(requests.Metric) != 1 {
+		t.Fatalf("Unexpected requests_total: %v", requests)
+	}
+	if requests.GetHelp() != `Requests "served".` {
+		t.Errorf("Unexpected help: %q", requests.GetHelp())
+	}
+	metric := requests.Metric[0]
+	if metric.GetLabel()[0].GetValue() != `/a"b` {
+		t.Errorf("Unexpected label: %v", metric.GetLabel())
+	}
+	if exemplar := metric.GetCounter().GetExemplar(); exemplar.GetValue() != 1.0 || exemplar.GetTimestamp().GetSeconds() != 1600000000 {
+		t.Errorf("Unexpected exemplar: %v", exemplar)
+	}
+	if created := meta.created[metric]; created != 1600000000.0 {
+		t.Errorf("Unexpected created: %v", created)
+	}
+	latency := families["latency_seconds"]
+	if latency == nil || len(latency.Metric[0].GetHistogram().GetBucket()) != 2 || latency.Metric[0].GetHistogram().GetSampleCount() != 5 {
+		t.Fatalf("Unexpected latency_seconds: %v", latency)
+	}
+	if meta.units["latency_seconds"] != "seconds" {
+		t.Errorf("Unexpected units: %v", meta.units)
+	}
+	if families["build_info"] == nil || families["size"].Metric[0].GetSummary().GetSampleSum() != 14.0 {
+		t.Errorf("Unexpected families: %v", families)
+	}
+	if queue := families["queue"]; queue == nil || queue.Metric[0].GetHistogram().GetSampleCount() != 4 || queue.Metric[0].GetHistogram().GetSampleSum() != 2.5 {
+		t.Errorf("Unexpected queue: %v", queue)
+	}
+	if families["door"] == nil || len(families["door"].Metric) != 2 {
+		t.Errorf("Unexpected door: %v", families["door"])
+	}
+	if meta.types["build_info"] != "info" || meta.types["queue"] != "gaugehistogram" || meta.types["door"] != "stateset" || len(meta.types) != 3 {
+		t.Errorf("Unexpected types: %v", meta.types)
+	}
+	if _, _, err := parseOpenMetrics([]byte("broken{a=\"1\" 1\n")); err == nil {
+		t.Errorf("Broken labels must be an error")
+	}
+}
+
+func TestParseOpenMetricsErrors(t *testing.T) {
+	for _, in := range []string{
+		"broken{a=\"1\" 1\n",
+		"foo{a b=\"1\"} 1\n",
+		"foo{a=\"1\"b=\"2\"} 1\n",
+		"foo{a=\"1\",a=\"2\"} 1\n",
+		"foo{1a=\"1\"} 1\n",
+		"foo{a=1} 1\n",
+		"foo{a=\"\\x\"} 1\n",
+		"foo-bar 1\n",
+		"foo 1 2 3\n",
+		"foo one\n",
+		"foo_total 1 # {a b=\"1\"} 1\n",
+		"foo_total 1 # {a=\"1\",a=\"2\"} 1\n",
+		"# TYPE foo-bar gauge\n",
+		"# TYPE foo nothing\n",
+		"# TYPE foo histogram\nfoo_bucket 1\n",
+	} {
+		if _, _, err := parseOpenMetrics([]byte(in + "# EOF\n")); err == nil {
+			t.Errorf("Invalid input must be an error: %q", in)
+		}
+	}
+	if _, _, err := parseOpenMetrics([]byte("foo{a=\"1\",b=\"2\",} 1\n# EOF\n")); err != nil {
+		t.Errorf("Trailing comma must be accepted: %v", err)
+	}
+}
+
+func TestMergeOpenMetrics(t *testing.T) {
+	merger := newMetricMerger()
+	if _, err := merger.add("a", &TargetConfig{Name: "a"}, [][]byte{[]byte(openMetricsOutput)}); err != nil {
+		t.Fatalf("Failed to add: %v", err)
+	}
+	// The same type as a gaugehistogram in dto, but not in OpenMetrics.
+	if _, err := merger.add("b", &TargetConfig{Name: "b"}, [][]byte{[]byte("# TYPE queue histogram\nqueue_bucket{le=\"+Inf\"} 1\nqueue_sum 1\nqueue_count 1\n")}); err != nil {
+		t.Fatalf("Failed to add: %v", err)
+	}
+	var out bytes.Buffer
+	if err := merger.writeOpenMetricsTo(&out); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	result := out.String()
+	for _, line := range []string{
+		"# TYPE latency_seconds histogram\n# UNIT latency_seconds seconds\n",
+		`requests_total{cradle_target="a",path="/a\"b"} 10.0 # {trace_id="abc"} 1.0 1.6000000005e+09` + "\n" +
+			`requests_created{cradle_target="a",path="/a\"b"} 1.6e+09` + "\n",
+		`latency_seconds_bucket{cradle_target="a",le="0.5"} 3 # {trace_id="def"} 0.25`,
+		`latency_seconds_created{cradle_target="a"} 1.6e+09`,
+		"# TYPE build info\n" + `build_info{cradle_target="a",version="1.0"} 1.0` + "\n",
+		"# TYPE door stateset\n",
+		"# TYPE queue gaugehistogram\n" + `queue_bucket{cradle_target="a",le="+Inf"} 4` + "\n" +
+			`queue_gsum{cradle_target="a"} 2.5` + "\n" + `queue_gcount{cradle_target="a"} 4` + "\n",
+		`cradle_probe_type_conflict{family="queue",target="b",type="histogram"} 1.0`,
+	} {
+		if !strings.Contains(result, line) {
+			t.Errorf("%q not found:\n%s", line, result)
+		}
+	}
+	if strings.Contains(result, "###") {
+		t.Errorf("Comments must be left out:\n%s", result)
+	}
+	if !strings.HasSuffix(result, "# EOF\n") {
+		t.Errorf("Output must end with # EOF:\n%s", result)
+	}
+	// The name of requests does not end with its unit, so UNIT must not be written.
+	if strings.Contains(result, "# UNIT requests") {
+		t.Errorf("Invalid UNIT written:\n%s", result)
+	}
+
+	out.Reset()
+	if err := merger.writeTo(&out); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	result = out.String()
+	if !strings.Contains(result, `requests_total{cradle_target="a",path="/a\"b"} 10`) || strings.Contains(result, "# EOF") {
+		t.Errorf("Unexpected text output:\n%s", result)
+	}
+	// The classic format has no gaugehistogram; its samples are written as they are.
+	for _, line := range []string{
+		`queue_bucket{cradle_target="a",le="+Inf"} 4`,
+		`queue_gcount{cradle_target="a"} 4`,
+		`queue_gsum{cradle_target="a"} 2.5`,
+		"# TYPE build_info gauge\n",
+	} {
+		if !strings.Contains(result, line) {
+			t.Errorf("%q not found:\n%s", line, result)
+		}
+	}
+	if strings.Contains(result, "queue_count") {
+		t.Errorf("Gaugehistogram must not be written as a histogram:\n%s", result)
+	}
+}
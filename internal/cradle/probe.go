@@ -0,0 +1,289 @@
+package cradle
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"go.uber.org/zap"
+)
+
+type scrapeResult struct {
+	name   string
+	target Target
+	// sections of the output, see sectionWriter.
+	sections [][]byte
+	err      error
+	duration time.Duration
+	samples  int
+	// truncated is true when the output exceeded body_size_limit.
+	truncated bool
+}
+
+// probeTimeout returns how long the whole probe can take.
+// Prometheus tells its scrape timeout by X-Prometheus-Scrape-Timeout-Seconds header;
+// we have to answer a bit before it, so the offset is subtracted.
+func probeTimeout(r *http.Request, config *Config) time.Duration {
+	timeout := config.Probe.Timeout
+	if header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); len(header) > 0 {
+		if seconds, err := strconv.ParseFloat(header, 64); err == nil && seconds > 0 {
+			timeout = time.Duration(seconds * float64(time.Second))
+		}
+	}
+	if timeout > config.Probe.TimeoutOffset {
+		timeout -= config.Probe.TimeoutOffset
+	}
+	return timeout
+}
+
+// selectTargets returns the sorted names of the targets selected by the query parameters.
+// "target" selects targets by name or glob pattern, and "target_re" by regular expression.
+// Both can be repeated. When neither of them is given, all targets are selected.
+func selectTargets(targets map[string]Target, query url.Values) ([]string, error) {
+	patterns := query["target"]
+	regexps := make([]*regexp.Regexp, 0, len(query["target_re"]))
+	for _, expr := range query["target_re"] {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid target_re: %v", err)
+		}
+		regexps = append(regexps, re)
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid target pattern: %s", pattern)
+		}
+	}
+	selectAll := len(patterns) == 0 && len(regexps) == 0
+	names := make([]string, 0, len(targets))
+	for name := range targets {
+		if selectAll || matchTargetName(name, patterns, regexps) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func matchTargetName(name string, patterns []string, regexps []*regexp.Regexp) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched || pattern == name {
+			return true
+		}
+	}
+	for _, re := range regexps {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateFormat picks the format of the probe output from the Accept header, and sets Content-Type.
+// It is OpenMetrics only when asked, and the classic text format otherwise.
+func negotiateFormat(w http.ResponseWriter, r *http.Request) expfmt.Format {
+	format := expfmt.NegotiateIncludingOpenMetrics(r.Header)
+	if format == expfmt.FmtOpenMetrics {
+		w.Header().Add("Content-Type", string(format))
+		return format
+	}
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	return expfmt.FmtText
+}
+
+// probe scrapes the named targets and writes the merged result.
+func (cradle *Cradle) probe(w io.Writer, r *http.Request, config *Config, targets map[string]Target, names []string, format expfmt.Format) {
+	log := zap.L()
+	ctx, cancel := context.WithTimeout(r.Context(), probeTimeout(r, config))
+	defer cancel()
+	results := scrapeTargets(ctx, targets, names, config.Probe.MaxConcurrency)
+	merger := newMetricMerger()
+	lastErrorTimestamps := make(map[string]float64)
+	for _, result := range results {
+		if result.sections == nil && result.err != nil {
+			merger.addError(result.name, result.err)
+		} else {
+			samples, err := merger.add(result.name, result.target.TargetConfig(), result.sections)
+			result.samples = samples
+			if result.err == nil {
+				result.err = err
+			}
+		}
+		if result.truncated {
+			cradle.metrics.observeTruncation(result.name)
+		}
+		if result.err != nil {
+			log.Warn("Failed to scrape target", zap.String("target", result.name), zap.Duration("duration", result.duration), zap.Error(result.err))
+			cradle.lastErrorTimestamps.Store(result.name, float64(time.Now().UnixNano())/1e9)
+		}
+		if timestamp, ok := cradle.lastErrorTimestamps.Load(result.name); ok {
+			lastErrorTimestamps[result.name] = timestamp.(float64)
+		}
+	}
+	for _, family := range targetStatusFamilies(results, lastErrorTimestamps) {
+		merger.addSelfFamily(family)
+	}
+	write := merger.writeTo
+	if format == expfmt.FmtOpenMetrics {
+		write = merger.writeOpenMetricsTo
+	}
+	if err := write(w); err != nil {
+		log.Warn("Failed to write entire probe result", zap.String("endpoint", config.Web.ProbePath), zap.Error(err))
+	}
+}
+
+// maxConcurrencyKey is the context key of probe.max_concurrency,
+// which also bounds how many endpoints of a target are scraped at once.
+type maxConcurrencyKey struct{}
+
+// bodySizeLimitKey is the context key of body_size_limit of the target being scraped,
+// which also bounds the memory to decompress the responses of its endpoints.
+type bodySizeLimitKey struct{}
+
+// scrapeTargets scrapes the named targets concurrently, at most maxConcurrency at once.
+// Results are returned in the same order as names.
+func scrapeTargets(ctx context.Context, targets map[string]Target, names []string, maxConcurrency int) []*scrapeResult {
+	ctx = context.WithValue(ctx, maxConcurrencyKey{}, maxConcurrency)
+	results := make([]*scrapeResult, len(names))
+	semaphore := make(chan struct{}, maxConcurrency)
+	var wg sync.WaitGroup
+	for idx, name := range names {
+		wg.Add(1)
+		go func(idx int, name string) {
+			defer wg.Done()
+			select {
+			case semaphore <- struct{}{}:
+				defer func() { <-semaphore }()
+			case <-ctx.Done():
+				results[idx] = &scrapeResult{
+					name:   name,
+					target: targets[name],
+					err:    fmt.Errorf("no worker became available before timeout: %v", ctx.Err()),
+				}
+				return
+			}
+			results[idx] = scrapeTarget(ctx, name, targets[name])
+		}(idx, name)
+	}
+	wg.Wait()
+	return results
+}
+
+// scrapeTarget scrapes a target with its own timeout.
+// When the target does not finish in time, it is reported as timed out and its output is discarded.
+// Otherwise the output is kept even on error, because it contains what went wrong.
+func scrapeTarget(ctx context.Context, name string, target Target) *scrapeResult {
+	if timeout := target.TargetConfig().Timeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	limit := target.TargetConfig().BodySizeLimit
+	ctx = context.WithValue(ctx, bodySizeLimitKey{}, limit)
+	result := &scrapeResult{
+		name:   name,
+		target: target,
+	}
+	type scraped struct {
+		sections  [][]byte
+		err       error
+		truncated bool
+	}
+	begin := time.Now()
+	done := make(chan scraped, 1)
+	go func() {
+		sw := &sectionWriter{}
+		lw := newLimitWriter(sw, limit)
+		err := target.Scrape(ctx, lw)
+		sections := sw.sections()
+		exceeded := lw.limitExceeded()
+		truncated := exceeded || errors.Is(err, errBodySizeLimit)
+		if exceeded && len(sections) > 0 {
+			// Drop the last line, which may be cut in the middle.
+			last := sections[len(sections)-1]
+			last = last[:bytes.LastIndexByte(last, '\n')+1]
+			last = append(last, "\n### Err: Body size limit exceeded\n"...)
+			last = append(last, "### Target: "+name+"\n"...)
+			last = append(last, fmt.Sprintf("### Limit: %d bytes\n", limit)...)
+			sections[len(sections)-1] = last
+		}
+		if exceeded {
+			err = fmt.Errorf("body size limit exceeded: %d bytes", limit)
+		}
+		done <- scraped{sections, err, truncated}
+	}()
+	select {
+	case s := <-done:
+		result.sections, result.err, result.truncated = s.sections, s.err, s.truncated
+	case <-ctx.Done():
+		result.err = fmt.Errorf("timed out: %v", ctx.Err())
+	}
+	result.duration = time.Since(begin)
+	return result
+}
+
+// Names of the synthetic metric families made by targetStatusFamilies.
+const (
+	targetUpFamilyName             = "cradle_target_up"
+	targetScrapeDurationFamilyName = "cradle_target_scrape_duration_seconds"
+	targetScrapeSamplesFamilyName  = "cradle_target_scrape_samples"
+	targetLastErrorFamilyName      = "cradle_target_last_error_timestamp_seconds"
+)
+
+// targetStatusFamilies makes synthetic metrics telling how each target was scraped,
+// like "up" and "scrape_duration_seconds" of Prometheus.
+func targetStatusFamilies(results []*scrapeResult, lastErrorTimestamps map[string]float64) []*dto.MetricFamily {
+	up := &dto.MetricFamily{
+		Name: proto.String(targetUpFamilyName),
+		Help: proto.String("1 if the target was scraped successfully, 0 otherwise."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	duration := &dto.MetricFamily{
+		Name: proto.String(targetScrapeDurationFamilyName),
+		Help: proto.String("Duration of scraping the target."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	samples := &dto.MetricFamily{
+		Name: proto.String(targetScrapeSamplesFamilyName),
+		Help: proto.String("Number of samples the target exposed."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	lastError := &dto.MetricFamily{
+		Name: proto.String(targetLastErrorFamilyName),
+		Help: proto.String("Unix time when the target failed to be scraped last time, 0 if never."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	for _, result := range results {
+		upValue := 1.0
+		if result.err != nil {
+			upValue = 0.0
+		}
+		up.Metric = append(up.Metric, newTargetStatusMetric(result.name, upValue))
+		duration.Metric = append(duration.Metric, newTargetStatusMetric(result.name, result.duration.Seconds()))
+		samples.Metric = append(samples.Metric, newTargetStatusMetric(result.name, float64(result.samples)))
+		lastError.Metric = append(lastError.Metric, newTargetStatusMetric(result.name, lastErrorTimestamps[result.name]))
+	}
+	return []*dto.MetricFamily{up, duration, samples, lastError}
+}
+
+func newTargetStatusMetric(name string, value float64) *dto.Metric {
+	return &dto.Metric{
+		Label: []*dto.LabelPair{
+			{Name: proto.String("target"), Value: proto.String(name)},
+		},
+		Gauge: &dto.Gauge{Value: proto.Float64(value)},
+	}
+}
@@ -0,0 +1,308 @@
+package cradle
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+func TestSelectTargets(t *testing.T) {
+	targets := map[string]Target{
+		"node-a":  &ScriptTarget{},
+		"node-b":  &ScriptTarget{},
+		"mysql":   &ExporterTarget{},
+		"haproxy": &ExporterTarget{},
+	}
+	cases := []struct {
+		query    string
+		expected []string
+	}{
+		{"", []string{"haproxy", "mysql", "node-a", "node-b"}},
+		{"target=mysql", []string{"mysql"}},
+		{"target=mysql&target=haproxy", []string{"haproxy", "mysql"}},
+		{"target=node-*", []string{"node-a", "node-b"}},
+		{"target_re=node-(a|c)", []string{"node-a"}},
+		{"target_re=node", []string{}},
+		{"target=mysql&target_re=.*-b", []string{"mysql", "node-b"}},
+	}
+	for _, c := range cases {
+		query, err := url.ParseQuery(c.query)
+		if err != nil {
+			t.Fatalf("Failed to parse query: %v", err)
+		}
+		names, err := selectTargets(targets, query)
+		if err != nil {
+			t.Errorf("Failed to select targets: query=%s, err=%v", c.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(names, c.expected) {
+			t.Errorf("Selected targets does not match: query=%s, %v != %v", c.query, names, c.expected)
+		}
+	}
+	if _, err := selectTargets(targets, url.Values{"target_re": {"("}}); err == nil {
+		t.Error("Invalid regexp must be rejected")
+	}
+}
+
+func TestScrapeTargetBodySizeLimit(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "metrics.prom")
+	if err := ioutil.WriteFile(path, []byte(strings.Repeat("metric 1\n", 100)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	target := &StaticFileTarget{
+		Config: &TargetConfig{
+			Name:          "static",
+			BodySizeLimit: 512,
+			StaticConfig:  &StaticFileConfig{Paths: []string{path}},
+		},
+	}
+	result := scrapeTarget(context.Background(), "static", target)
+	if !result.truncated || result.err == nil {
+		t.Fatalf("Output must be truncated: %v", result.err)
+	}
+	if len(result.sections) != 1 {
+		t.Fatalf("Unexpected sections: %d", len(result.sections))
+	}
+	output := result.sections[0]
+	if !strings.Contains(string(output), "### Err: Body size limit exceeded") {
+		t.Errorf("No marker in output: %s", output)
+	}
+	if len(output) > 512+100 {
+		t.Errorf("Output too large: %d bytes", len(output))
+	}
+	merger := newMetricMerger()
+	if _, err := merger.add("static", target.Config, result.sections); err != nil {
+		t.Errorf("Truncated output must be parsable: %v", err)
+	}
+}
+
+func TestScrapeScriptBodySizeLimit(t *testing.T) {
+	cfg, err := ReadTargetConfig([]byte(`
+name: script
+body_size_limit: 512
+script:
+  path: /bin/sh
+  args: ['-c', 'i=0; while [ $i -lt 1000 ]; do echo "metric_$i 1"; i=$((i+1)); done']
+`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	target, err := newTarget(cfg, false)
+	if err != nil {
+		t.Fatalf("Failed to make target: %v", err)
+	}
+	result := scrapeTarget(context.Background(), "script", target)
+	if !result.truncated || result.err == nil {
+		t.Fatalf("Output must be truncated: %v", result.err)
+	}
+	output := string(bytes.Join(result.sections, nil))
+	// The output is kept up to the limit, like the one of endpoints.
+	for _, line := range []string{"### Target: script\n", "metric_0 1\n", "metric_10 1\n", "### Err: Body size limit exceeded\n"} {
+		if !strings.Contains(output, line) {
+			t.Errorf("%q not found:\n%s", line, output)
+		}
+	}
+	if len(output) > 512+100 {
+		t.Errorf("Output too large: %d bytes", len(output))
+	}
+	merger := newMetricMerger()
+	if _, err := merger.add("script", target.TargetConfig(), result.sections); err != nil {
+		t.Errorf("Truncated output must be parsable: %v", err)
+	}
+}
+
+func TestScrapeEndpointsBodySizeLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Endless, so that the scrape must be stopped by the limit.
+		for i := 0; ; i++ {
+			if _, err := fmt.Fprintf(w, "metric{path=%q,i=\"%d\"} 1\n", r.URL.Path, i); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+	endpoints := make([]string, 0)
+	for i := 0; i < 4; i++ {
+		endpoints = append(endpoints, fmt.Sprintf("%s/%d", server.URL, i))
+	}
+	const limit = 4096
+	target := &ExporterTarget{
+		Config: &TargetConfig{
+			Name:           "exporter",
+			Timeout:        10 * time.Second,
+			BodySizeLimit:  limit,
+			ExporterConfig: &ExporterConfig{Endpoints: endpoints},
+		},
+	}
+	result := scrapeTarget(context.Background(), "exporter", target)
+	if !result.truncated || result.err == nil {
+		t.Fatalf("Output must be truncated: %v", result.err)
+	}
+	size := 0
+	for _, section := range result.sections {
+		size += len(section)
+	}
+	if size > limit+100 {
+		t.Errorf("Output of all the endpoints must be limited together: %d bytes", size)
+	}
+	merger := newMetricMerger()
+	if _, err := merger.add("exporter", target.Config, result.sections); err != nil {
+		t.Errorf("Truncated output must be parsable: %v", err)
+	}
+}
+
+// sleepingTarget sleeps in Scrape until it is done or cancelled, and counts how many of them run at once.
+type sleepingTarget struct {
+	config     *TargetConfig
+	sleep      time.Duration
+	running    *atomic.Int32
+	maxRunning *atomic.Int32
+}
+
+// storeMax stores n to max if n is greater.
+func storeMax(max *atomic.Int32, n int32) {
+	for current := max.Load(); n > current; current = max.Load() {
+		if max.CAS(current, n) {
+			return
+		}
+	}
+}
+
+func (target *sleepingTarget) Scrape(ctx context.Context, w io.Writer) error {
+	defer target.running.Dec()
+	storeMax(target.maxRunning, target.running.Inc())
+	timer := time.NewTimer(target.sleep)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+	}
+	_, _ = io.WriteString(w, "### Sleeping Target\n")
+	_, _ = io.WriteString(w, "slept 1\n")
+	return nil
+}
+
+func (target *sleepingTarget) Name() string {
+	return target.config.Name
+}
+
+func (target *sleepingTarget) ConfigFilePath() string {
+	return ""
+}
+
+func (target *sleepingTarget) TargetConfig() *TargetConfig {
+	return target.config
+}
+
+func TestScrapeTargetsConcurrently(t *testing.T) {
+	running, maxRunning := atomic.NewInt32(0), atomic.NewInt32(0)
+	targets := make(map[string]Target)
+	names := make([]string, 0)
+	for i := 0; i < 6; i++ {
+		name := fmt.Sprintf("target-%d", i)
+		targets[name] = &sleepingTarget{
+			config:     &TargetConfig{Name: name},
+			sleep:      50 * time.Millisecond,
+			running:    running,
+			maxRunning: maxRunning,
+		}
+		names = append(names, name)
+	}
+	results := scrapeTargets(context.Background(), targets, names, 2)
+	for idx, result := range results {
+		if result.name != names[idx] {
+			t.Errorf("Results must be in the order of names: %s != %s", result.name, names[idx])
+		}
+		if result.err != nil {
+			t.Errorf("Failed to scrape %s: %v", result.name, result.err)
+		}
+	}
+	if max := maxRunning.Load(); max != 2 {
+		t.Errorf("Targets must be scraped 2 at once, but %d at once", max)
+	}
+}
+
+func TestScrapeTargetTimeout(t *testing.T) {
+	target := &sleepingTarget{
+		config:     &TargetConfig{Name: "slow", Timeout: 50 * time.Millisecond},
+		sleep:      10 * time.Second,
+		running:    atomic.NewInt32(0),
+		maxRunning: atomic.NewInt32(0),
+	}
+	result := scrapeTarget(context.Background(), "slow", target)
+	if result.err == nil || !strings.Contains(result.err.Error(), "timed out") {
+		t.Errorf("Target must time out: %v", result.err)
+	}
+	if result.sections != nil {
+		t.Errorf("Output of timed out target must be discarded: %q", result.sections)
+	}
+	if result.duration > time.Second {
+		t.Errorf("Timeout of the target must be applied: %v", result.duration)
+	}
+}
+
+func TestProbeTimeout(t *testing.T) {
+	config := &Config{Probe: ProbeConfig{Timeout: 10 * time.Second, TimeoutOffset: 500 * time.Millisecond}}
+	cases := []struct {
+		header   string
+		expected time.Duration
+	}{
+		{"", 9500 * time.Millisecond},
+		{"3", 2500 * time.Millisecond},
+		{"0.25", 250 * time.Millisecond},
+		{"invalid", 9500 * time.Millisecond},
+		{"-1", 9500 * time.Millisecond},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/probe", nil)
+		if len(c.header) > 0 {
+			r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", c.header)
+		}
+		if timeout := probeTimeout(r, config); timeout != c.expected {
+			t.Errorf("Unexpected timeout for %q: %v != %v", c.header, timeout, c.expected)
+		}
+	}
+}
+
+func TestScrapeEndpointsConcurrency(t *testing.T) {
+	running, maxRunning := atomic.NewInt32(0), atomic.NewInt32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer running.Dec()
+		storeMax(maxRunning, running.Inc())
+		time.Sleep(50 * time.Millisecond)
+		_, _ = io.WriteString(w, "up{path=\""+r.URL.Path+"\"} 1\n")
+	}))
+	defer server.Close()
+	endpoints := make([]string, 0)
+	for i := 0; i < 5; i++ {
+		endpoints = append(endpoints, fmt.Sprintf("%s/%d", server.URL, i))
+	}
+	ctx := context.WithValue(context.Background(), maxConcurrencyKey{}, 2)
+	var buff bytes.Buffer
+	if err := scrapeEndpoints(ctx, &buff, "target", nil, endpoints); err != nil {
+		t.Fatalf("Failed to scrape: %v", err)
+	}
+	if max := maxRunning.Load(); max > 2 {
+		t.Errorf("Endpoints must be scraped at most 2 at once, but %d at once", max)
+	}
+	output := buff.String()
+	for i := 0; i < 5; i++ {
+		if !strings.Contains(output, fmt.Sprintf(`up{path="/%d"} 1`, i)) {
+			t.Errorf("Endpoint %d not scraped:\n%s", i, output)
+		}
+	}
+}
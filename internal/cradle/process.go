@@ -0,0 +1,206 @@
+package cradle
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// process is a ProcessConfig checked and resolved, ready to be launched.
+type process struct {
+	name       string
+	config     *ProcessConfig
+	credential *credential
+	// stopSignal is sent to stop the process. If nil, it is killed at once.
+	stopSignal os.Signal
+	// stopTimeout is how long to wait for the process to exit after stopSignal, before killing it.
+	stopTimeout time.Duration
+}
+
+// credential is the user and groups to launch a process as.
+type credential struct {
+	uid    uint32
+	gid    uint32
+	groups []uint32
+	// username and home are of the user; empty when only groups are set.
+	username string
+	home     string
+}
+
+// environ returns HOME, USER and LOGNAME of the user, so that the process does not see the ones of cradle.
+func (cred *credential) environ() []string {
+	if cred == nil || len(cred.username) == 0 {
+		return nil
+	}
+	return []string{"HOME=" + cred.home, "USER=" + cred.username, "LOGNAME=" + cred.username}
+}
+
+// newProcess checks the config can be used to launch a process,
+// and resolves the user and groups to launch it as.
+func newProcess(name string, cfg *ProcessConfig) (*process, error) {
+	if len(cfg.Path) == 0 {
+		return nil, fmt.Errorf("path is empty")
+	}
+	if _, err := cfg.environ(nil); err != nil {
+		return nil, err
+	}
+	if len(cfg.WorkDir) > 0 {
+		info, err := os.Stat(cfg.WorkDir)
+		if err != nil {
+			return nil, fmt.Errorf("invalid workdir: %v", err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("workdir is not dir: %s", cfg.WorkDir)
+		}
+	}
+	if err := checkLimits(cfg); err != nil {
+		return nil, err
+	}
+	cred, err := resolveCredential(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &process{
+		name:       name,
+		config:     cfg,
+		credential: cred,
+	}, nil
+}
+
+// command builds a command to launch the process. Launch it by start or run.
+func (p *process) command() (*exec.Cmd, error) {
+	cfg := p.config
+	env, err := cfg.environ(p.credential.environ())
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(cfg.Path, cfg.Args...)
+	cmd.Env = env
+	cmd.Dir = cfg.WorkDir
+	if cfg.Stdin != nil {
+		cmd.Stdin = strings.NewReader(*cfg.Stdin)
+	}
+	setCredential(cmd, p.credential)
+	setProcessGroup(cmd)
+	return cmd, nil
+}
+
+// start starts the command in its own process group, and applies the limits to it.
+// When ctx is done before the command exits, the whole process group is stopped,
+// so that children forked by the process do not survive it.
+// The returned func waits for the command to exit, and must be called.
+func (p *process) start(ctx context.Context, cmd *exec.Cmd) (func() error, error) {
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	if err := applyLimits(cmd.Process.Pid, p.config); err != nil {
+		killProcessGroup(cmd.Process)
+		_ = cmd.Wait()
+		return nil, fmt.Errorf("failed to apply limits: %v", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.stop(cmd.Process, exited)
+		case <-exited:
+		}
+	}()
+	return func() error {
+		defer close(exited)
+		return cmd.Wait()
+	}, nil
+}
+
+// stop sends stopSignal to the process group, and kills it if it does not exit in stopTimeout.
+func (p *process) stop(proc *os.Process, exited <-chan struct{}) {
+	log := zap.L()
+	if p.stopSignal == nil {
+		killProcessGroup(proc)
+		return
+	}
+	if err := signalProcessGroup(proc, p.stopSignal); err != nil {
+		log.Warn("Failed to send stop signal, killing", zap.String("target", p.name), zap.Error(err))
+		killProcessGroup(proc)
+		return
+	}
+	timer := time.NewTimer(p.stopTimeout)
+	defer timer.Stop()
+	select {
+	case <-exited:
+	case <-timer.C:
+		log.Warn("Process did not stop in time, killing",
+			zap.String("target", p.name),
+			zap.Duration("stop-timeout", p.stopTimeout))
+		killProcessGroup(proc)
+	}
+}
+
+// run starts the command and waits for it to exit.
+func (p *process) run(ctx context.Context, cmd *exec.Cmd) error {
+	wait, err := p.start(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	return wait()
+}
+
+// environ returns the environment of the process:
+// the one of cradle (unless inherit_env is false), then userEnv, then env_file, then env.
+func (cfg *ProcessConfig) environ(userEnv []string) ([]string, error) {
+	env := make([]string, 0)
+	if cfg.InheritEnv == nil || *cfg.InheritEnv {
+		env = append(env, os.Environ()...)
+	}
+	env = append(env, userEnv...)
+	if len(cfg.EnvFile) > 0 {
+		fileEnv, err := readEnvFile(cfg.EnvFile)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, fileEnv...)
+	}
+	names := make([]string, 0, len(cfg.Env))
+	for name := range cfg.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, name+"="+cfg.Env[name])
+	}
+	return env, nil
+}
+
+// readEnvFile reads "NAME=value" lines. Empty lines and lines starting with '#' are ignored.
+func readEnvFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open env file: %v", err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	env := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if idx := strings.Index(line, "="); idx <= 0 {
+			return nil, fmt.Errorf("invalid line in env file: %s:%d", path, lineNo)
+		}
+		env = append(env, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read env file: %v", err)
+	}
+	return env, nil
+}
@@ -0,0 +1,40 @@
+package cradle
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestProcessEnviron(t *testing.T) {
+	dir := t.TempDir()
+	envFile := filepath.Join(dir, "env")
+	if err := ioutil.WriteFile(envFile, []byte("# comment\n\nFOO=from-file\nBAR=bar\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := ReadTargetConfig([]byte(`
+script:
+  path: /usr/bin/script
+  env_file: ` + envFile + `
+  env:
+    FOO: foo
+  inherit_env: false
+  workdir: /tmp
+  stdin: input
+`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if conf.ScriptConfig.WorkDir != "/tmp" || conf.ScriptConfig.Stdin == nil || *conf.ScriptConfig.Stdin != "input" {
+		t.Errorf("Process config does not match: %+v", conf.ScriptConfig.ProcessConfig)
+	}
+	env, err := conf.ScriptConfig.environ(nil)
+	if err != nil {
+		t.Fatalf("Failed to make environ: %v", err)
+	}
+	expected := []string{"FOO=from-file", "BAR=bar", "FOO=foo"}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("Environ does not match: %v != %v", env, expected)
+	}
+}
@@ -0,0 +1,165 @@
+//go:build !windows
+// +build !windows
+
+package cradle
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// resolveCredential looks up the user and groups in the config.
+// nil is returned when none of them is set, to launch the process as cradle itself.
+func resolveCredential(cfg *ProcessConfig) (*credential, error) {
+	if len(cfg.User) == 0 && len(cfg.Group) == 0 && len(cfg.Groups) == 0 {
+		return nil, nil
+	}
+	cred := &credential{
+		uid:    uint32(os.Getuid()),
+		gid:    uint32(os.Getgid()),
+		groups: make([]uint32, 0),
+	}
+	var groupIds []string
+	if len(cfg.User) > 0 {
+		u, err := lookupUser(cfg.User)
+		if err != nil {
+			return nil, err
+		}
+		if cred.uid, err = parseId(u.Uid); err != nil {
+			return nil, err
+		}
+		if cred.gid, err = parseId(u.Gid); err != nil {
+			return nil, err
+		}
+		cred.username = u.Username
+		cred.home = u.HomeDir
+		// Not all platforms can list them; then the user has no supplementary groups.
+		groupIds, _ = u.GroupIds()
+	}
+	if len(cfg.Group) > 0 {
+		gid, err := lookupGroup(cfg.Group)
+		if err != nil {
+			return nil, err
+		}
+		cred.gid = gid
+	}
+	if len(cfg.Groups) > 0 {
+		groupIds = nil
+		for _, name := range cfg.Groups {
+			gid, err := lookupGroup(name)
+			if err != nil {
+				return nil, err
+			}
+			cred.groups = append(cred.groups, gid)
+		}
+	}
+	for _, id := range groupIds {
+		gid, err := parseId(id)
+		if err != nil {
+			return nil, err
+		}
+		cred.groups = append(cred.groups, gid)
+	}
+	return cred, nil
+}
+
+func lookupUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	if _, ok := err.(user.UnknownUserError); ok {
+		if _, parseErr := parseId(name); parseErr == nil {
+			u, err = user.LookupId(name)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unknown user %q: %v", name, err)
+	}
+	return u, nil
+}
+
+func lookupGroup(name string) (uint32, error) {
+	g, err := user.LookupGroup(name)
+	if _, ok := err.(user.UnknownGroupError); ok {
+		if _, parseErr := parseId(name); parseErr == nil {
+			g, err = user.LookupGroupId(name)
+		}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("unknown group %q: %v", name, err)
+	}
+	return parseId(g.Gid)
+}
+
+func parseId(id string) (uint32, error) {
+	value, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid id %q: %v", id, err)
+	}
+	return uint32(value), nil
+}
+
+func setCredential(cmd *exec.Cmd, cred *credential) {
+	if cred == nil {
+		return
+	}
+	sysProcAttr(cmd).Credential = &syscall.Credential{
+		Uid:    cred.uid,
+		Gid:    cred.gid,
+		Groups: cred.groups,
+	}
+}
+
+// setProcessGroup makes the process the leader of a new process group.
+func setProcessGroup(cmd *exec.Cmd) {
+	sysProcAttr(cmd).Setpgid = true
+}
+
+// killProcessGroup kills all the processes in the group led by the process.
+func killProcessGroup(proc *os.Process) {
+	// Negative pid means the process group.
+	if err := syscall.Kill(-proc.Pid, syscall.SIGKILL); err != nil {
+		_ = proc.Kill()
+	}
+}
+
+func sysProcAttr(cmd *exec.Cmd) *syscall.SysProcAttr {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	return cmd.SysProcAttr
+}
+
+var stopSignals = map[string]syscall.Signal{
+	"SIGTERM": syscall.SIGTERM,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+	"SIGKILL": syscall.SIGKILL,
+}
+
+// parseStopSignal parses a signal name like "SIGTERM" or "TERM". Empty means SIGTERM.
+func parseStopSignal(name string) (os.Signal, error) {
+	if len(name) == 0 {
+		return syscall.SIGTERM, nil
+	}
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, ok := stopSignals[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported stop signal: %s", name)
+	}
+	return sig, nil
+}
+
+// signalProcessGroup sends the signal to all the processes in the group led by the process.
+func signalProcessGroup(proc *os.Process, sig os.Signal) error {
+	return syscall.Kill(-proc.Pid, sig.(syscall.Signal))
+}
@@ -0,0 +1,186 @@
+//go:build !windows
+// +build !windows
+
+package cradle
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func TestProcessCredential(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skipf("Current user unknown: %v", err)
+	}
+	inheritEnv := false
+	cfg := &ProcessConfig{
+		Path:       "/bin/true",
+		User:       current.Username,
+		Groups:     []string{current.Gid},
+		Env:        map[string]string{"USER": "overridden"},
+		InheritEnv: &inheritEnv,
+	}
+	p, err := newProcess("script", cfg)
+	if err != nil {
+		t.Fatalf("Failed to make process: %v", err)
+	}
+	cmd, err := p.command()
+	if err != nil {
+		t.Fatalf("Failed to make command: %v", err)
+	}
+	cred := cmd.SysProcAttr.Credential
+	if cred == nil {
+		t.Fatal("Credential must be set")
+	}
+	uid, _ := strconv.ParseUint(current.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(current.Gid, 10, 32)
+	if uint64(cred.Uid) != uid || uint64(cred.Gid) != gid || !reflect.DeepEqual(cred.Groups, []uint32{uint32(gid)}) {
+		t.Errorf("Credential does not match: %+v", cred)
+	}
+	expected := []string{
+		"HOME=" + current.HomeDir,
+		"USER=" + current.Username,
+		"LOGNAME=" + current.Username,
+		"USER=overridden",
+	}
+	if !reflect.DeepEqual(cmd.Env, expected) {
+		t.Errorf("Environ does not match: %v != %v", cmd.Env, expected)
+	}
+
+	// Only groups are set; the user is cradle itself, and its environment is kept.
+	p, err = newProcess("script", &ProcessConfig{Path: "/bin/true", Groups: []string{current.Gid}, InheritEnv: &inheritEnv})
+	if err != nil {
+		t.Fatalf("Failed to make process: %v", err)
+	}
+	if cmd, err = p.command(); err != nil {
+		t.Fatalf("Failed to make command: %v", err)
+	}
+	if len(cmd.Env) != 0 {
+		t.Errorf("Environ of the user must not be set without user: %v", cmd.Env)
+	}
+}
+
+// processAlive tells whether the process is running. Zombies not reaped yet are dead.
+func processAlive(pid int) bool {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		// No procfs; zombies are taken as alive.
+		return syscall.Kill(pid, 0) == nil
+	}
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	// The state follows the command name in parentheses.
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z" && fields[0] != "X"
+}
+
+func TestProcessGroupKilledOnTimeout(t *testing.T) {
+	// The child would survive its parent, if only the parent were killed.
+	p, err := newProcess("script", &ProcessConfig{
+		Path: "/bin/sh",
+		Args: []string{"-c", "sleep 30 >/dev/null 2>&1 & echo $!; wait"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to make process: %v", err)
+	}
+	cmd, err := p.command()
+	if err != nil {
+		t.Fatalf("Failed to make command: %v", err)
+	}
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	if err := p.run(ctx, cmd); err == nil {
+		t.Error("Killed process must fail")
+	}
+	if elapsed := time.Since(begin); elapsed > 5*time.Second {
+		t.Errorf("Process must be killed on timeout: %v", elapsed)
+	}
+	child, err := strconv.Atoi(strings.TrimSpace(stdout.String()))
+	if err != nil {
+		t.Fatalf("Failed to read the pid of the child: %q", stdout.String())
+	}
+	waitFor(t, 5*time.Second, "the child to be killed", func() bool {
+		return !processAlive(child)
+	})
+}
+
+func TestProcessStopSignal(t *testing.T) {
+	cases := []struct {
+		name   string
+		script string
+		killed bool
+	}{
+		{"exits on SIGTERM", `trap 'echo term; exit 0' TERM; echo started; while :; do sleep 0.05; done`, false},
+		{"ignores SIGTERM", `trap 'echo term' TERM; echo started; while :; do sleep 0.05; done`, true},
+	}
+	const stopTimeout = 500 * time.Millisecond
+	for _, c := range cases {
+		p, err := newProcess("daemon", &ProcessConfig{Path: "/bin/sh", Args: []string{"-c", c.script}})
+		if err != nil {
+			t.Fatalf("Failed to make process: %v", err)
+		}
+		p.stopSignal = syscall.SIGTERM
+		p.stopTimeout = stopTimeout
+		cmd, err := p.command()
+		if err != nil {
+			t.Fatalf("Failed to make command: %v", err)
+		}
+		stdout := newDaemonLog("daemon", "stdout", zapcore.DebugLevel, 0)
+		cmd.Stdout = stdout
+		written := func(text string) bool {
+			for _, line := range stdout.Lines() {
+				if line.text == text {
+					return true
+				}
+			}
+			return false
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		wait, err := p.start(ctx, cmd)
+		if err != nil {
+			t.Fatalf("Failed to start: %v", err)
+		}
+		waitFor(t, 5*time.Second, "the trap to be set", func() bool {
+			return written("started")
+		})
+		begin := time.Now()
+		cancel()
+		err = wait()
+		elapsed := time.Since(begin)
+		if !written("term") {
+			t.Errorf("%s: Stop signal must be sent first: %v", c.name, stdout.Lines())
+		}
+		if c.killed {
+			if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); !ok || status.Signal() != syscall.SIGKILL {
+				t.Errorf("%s: Process must be killed: %v", c.name, err)
+			}
+			if elapsed < stopTimeout {
+				t.Errorf("%s: Process must be killed only after the stop timeout: %v", c.name, elapsed)
+			}
+		} else {
+			if err != nil {
+				t.Errorf("%s: Process must exit by itself: %v", c.name, err)
+			}
+			if elapsed >= stopTimeout {
+				t.Errorf("%s: Process must exit before the stop timeout: %v", c.name, elapsed)
+			}
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package cradle
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+func resolveCredential(cfg *ProcessConfig) (*credential, error) {
+	if len(cfg.User) == 0 && len(cfg.Group) == 0 && len(cfg.Groups) == 0 {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("user and group are not supported on windows")
+}
+
+func setCredential(_ *exec.Cmd, _ *credential) {
+}
+
+func setProcessGroup(_ *exec.Cmd) {
+}
+
+// killProcessGroup kills only the process itself; Windows has no process groups to kill at once.
+func killProcessGroup(proc *os.Process) {
+	_ = proc.Kill()
+}
+
+// parseStopSignal accepts only SIGKILL, because other signals cannot be sent on Windows.
+func parseStopSignal(name string) (os.Signal, error) {
+	switch name {
+	case "", "SIGKILL", "KILL":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("stop signals other than SIGKILL are not supported on windows")
+	}
+}
+
+func signalProcessGroup(proc *os.Process, _ os.Signal) error {
+	return proc.Kill()
+}
@@ -5,82 +5,342 @@ import (
 	"os/exec"
 	"sync"
 	"syscall"
+	"time"
 
-	"github.com/robfig/cron"
 	"go.uber.org/atomic"
 	"go.uber.org/zap"
 )
 
+// Runner supervises service daemons and schedules cron jobs.
+// It lives as long as cradle, and Update starts or stops only the targets that changed.
 type Runner struct {
 	context context.Context
 	cancel  context.CancelFunc
-	targets map[string]Target
-	cron    *cron.Cron
-	daemons []*ServiceTarget
-	halted  atomic.Bool
+	// updating serializes Update, so that a job is not started until the old one of the same target stops.
+	updating sync.Mutex
+	mutex    sync.Mutex
+	jobs     map[string]*job
+	wg       sync.WaitGroup
+	halted   atomic.Bool
+	metrics  *collector
 }
 
-type ZapInfoWriter struct{}
+// job is a daemon or a cron schedule running for a target.
+type job struct {
+	target Target
+	cancel context.CancelFunc
+	done   chan struct{}
+}
 
-func (_ ZapInfoWriter) Write(p []byte) (n int, err error) {
+func newRunner(metrics *collector) *Runner {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Runner{
+		context: ctx,
+		cancel:  cancel,
+		jobs:    make(map[string]*job),
+		metrics: metrics,
+	}
+}
+
+// Update makes the running jobs match the targets.
+// Jobs whose target is the very same one as before keep running; the others are stopped or started.
+func (r *Runner) Update(targets map[string]Target) {
+	r.updating.Lock()
+	defer r.updating.Unlock()
+	// Stop the jobs all at once, and wait for them without the lock,
+	// so that daemons slow to stop neither stop one by one nor block Shutdown.
+	for _, j := range r.stopRemovedJobs(targets) {
+		<-j.done
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.halted.Load() {
+		return
+	}
+	for name, target := range targets {
+		if _, ok := r.jobs[name]; ok {
+			continue
+		}
+		var run func(ctx context.Context)
+		switch target := target.(type) {
+		case *CronJobTarget:
+			run = func(ctx context.Context) {
+				r.runCronJob(ctx, target)
+			}
+		case *ServiceTarget:
+			run = func(ctx context.Context) {
+				r.runDaemon(ctx, target)
+			}
+		default:
+			continue
+		}
+		ctx, cancel := context.WithCancel(r.context)
+		j := &job{
+			target: target,
+			cancel: cancel,
+			done:   make(chan struct{}),
+		}
+		r.jobs[name] = j
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			defer close(j.done)
+			run(ctx)
+		}()
+	}
+}
+
+// stopRemovedJobs cancels the jobs whose target is not the very same one any more, and returns them.
+func (r *Runner) stopRemovedJobs(targets map[string]Target) []*job {
 	log := zap.L()
-	log.Info("daemon/stdout", zap.String("msg", string(p)))
-	return len(p), err
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	stopping := make([]*job, 0)
+	for name, j := range r.jobs {
+		if target, ok := targets[name]; ok && target == j.target {
+			continue
+		}
+		log.Info("Stopping job", zap.String("target", name))
+		j.cancel()
+		stopping = append(stopping, j)
+		delete(r.jobs, name)
+	}
+	return stopping
 }
 
-type ZapErrorWriter struct{}
+func (r *Runner) runCronJob(ctx context.Context, target *CronJobTarget) {
+	for {
+		now := time.Now()
+		timer := time.NewTimer(target.schedule.Next(now).Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		begin := time.Now()
+		err := target.update(ctx)
+		r.metrics.observeCronJobRun(target.Name(), time.Since(begin), err)
+	}
+}
 
-func (_ ZapErrorWriter) Write(p []byte) (n int, err error) {
+// runDaemon keeps the daemon running, restarting it with exponential backoff when it dies.
+// If it dies too often, it is marked as failed and left dead until the context is cancelled.
+func (r *Runner) runDaemon(ctx context.Context, daemon *ServiceTarget) {
 	log := zap.L()
-	log.Info("daemon/stderr", zap.String("msg", string(p)))
-	return len(p), err
+	defer daemon.setState(DaemonStopped)
+	restart := daemon.Config.ServiceConfig.Restart.withDefaults()
+	restarts := make([]time.Time, 0)
+	attempt := 0
+	for ctx.Err() == nil {
+		begin := time.Now()
+		exitCode, reason := r.execDaemon(ctx, daemon)
+		daemon.setExited(exitCode)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(begin) >= restart.MaxBackoff {
+			// It ran long enough; not a crash loop.
+			attempt = 0
+		}
+		now := time.Now()
+		recent := restarts[:0]
+		for _, t := range restarts {
+			if now.Sub(t) < restart.Window {
+				recent = append(recent, t)
+			}
+		}
+		restarts = append(recent, now)
+		if restart.MaxRestarts > 0 && len(restarts) > restart.MaxRestarts {
+			log.Error("Daemon is crash looping, giving up restarting",
+				zap.String("target", daemon.Name()),
+				zap.Int("max-restarts", restart.MaxRestarts),
+				zap.Duration("window", restart.Window))
+			daemon.setState(DaemonFailed)
+			<-ctx.Done()
+			return
+		}
+		backoff := restart.backoff(attempt)
+		attempt++
+		log.Warn("Restarting daemon after backoff", zap.String("target", daemon.Name()), zap.Duration("backoff", backoff))
+		daemon.setState(DaemonBackoff)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		daemon.addRestart()
+		r.metrics.observeDaemonRestart(daemon.Name(), reason)
+	}
 }
 
-func (r *Runner) Run() error {
-	var wg sync.WaitGroup
-	r.cron.Start()
-	for _, daemon := range r.daemons {
-		log := zap.L()
-		wg.Add(1)
-		go func(daemon *ServiceTarget) {
-			defer wg.Done()
-			var err error
-			for !r.halted.Load() {
-				args := []string{daemon.Config.ServiceConfig.Path}
-				args = append(args, daemon.Config.ServiceConfig.Args...)
-				log.Info("Daemon starting...",
-					zap.String("config-path", daemon.ConfigFilePath()),
-					zap.Strings("args", args))
-				cmd := exec.CommandContext(r.context, daemon.Config.ServiceConfig.Path, daemon.Config.ServiceConfig.Args...)
-				cmd.Stdout = ZapInfoWriter{}
-				cmd.Stderr = ZapErrorWriter{}
-				err = cmd.Start()
-				if err != nil {
-					log.Error("Failed to start daemon", zap.String("config-path", daemon.ConfigFilePath()), zap.Error(err))
+// Reasons why a daemon is restarted.
+const (
+	restartReasonExited   = "exited"
+	restartReasonLiveness = "liveness"
+)
+
+// execDaemon runs the daemon until it exits, and returns its exit code and why it exited.
+// -1 is returned when it could not be started or was killed by a signal.
+func (r *Runner) execDaemon(ctx context.Context, daemon *ServiceTarget) (int, string) {
+	log := zap.L()
+	daemon.setState(DaemonStarting)
+	args := []string{daemon.service.Path}
+	args = append(args, daemon.service.Args...)
+	log.Info("Daemon starting...",
+		zap.String("target", daemon.Name()),
+		zap.Strings("args", args),
+		zap.Int("port", daemon.port))
+	cmd, err := daemon.process.command()
+	if err != nil {
+		log.Error("Failed to prepare daemon", zap.String("target", daemon.Name()), zap.Error(err))
+		return -1, restartReasonExited
+	}
+	cmd.Stdout = daemon.stdout
+	cmd.Stderr = daemon.stderr
+	defer daemon.stdout.Flush()
+	defer daemon.stderr.Flush()
+	// Cancelled when the daemon exits, or to kill it when it is not alive.
+	runCtx, cancelRun := context.WithCancel(ctx)
+	var checks sync.WaitGroup
+	defer checks.Wait()
+	defer cancelRun()
+	wait, err := daemon.process.start(runCtx, cmd)
+	if err != nil {
+		log.Error("Failed to start daemon", zap.String("target", daemon.Name()), zap.Error(err))
+		return -1, restartReasonExited
+	}
+	if daemon.readiness != nil {
+		checks.Add(1)
+		go func() {
+			defer checks.Done()
+			r.watchReadiness(runCtx, daemon)
+		}()
+	} else {
+		daemon.setState(DaemonRunning)
+	}
+	var notAlive atomic.Bool
+	if daemon.liveness != nil {
+		checks.Add(1)
+		go func() {
+			defer checks.Done()
+			if !r.watchLiveness(runCtx, daemon) {
+				notAlive.Store(true)
+				cancelRun()
+			}
+		}()
+	}
+	err = wait()
+	// notAlive is set before the daemon is killed.
+	reason := restartReasonExited
+	if notAlive.Load() {
+		reason = restartReasonLiveness
+	}
+	if err != nil {
+		if exiterr, ok := err.(*exec.ExitError); ok {
+			// See https://stackoverflow.com/a/10385867
+			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
+				if status.Signaled() {
+					log.Error("Daemon caught signal", zap.String("target", daemon.Name()), zap.String("signal", status.Signal().String()))
+					return -1, reason
 				}
-				err = cmd.Wait()
-				if err != nil {
-					if exiterr, ok := err.(*exec.ExitError); ok {
-						// See https://stackoverflow.com/a/10385867
-						if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-							if status.Signaled() {
-								log.Error("Daemon caught signal", zap.String("config-path", daemon.ConfigFilePath()), zap.String("signal", status.StopSignal().String()))
-							}
-							if status.Exited() {
-								log.Error("Daemon dead", zap.String("config-path", daemon.ConfigFilePath()), zap.Int("exit-status", status.ExitStatus()))
-							}
-						}
-					}
+				if status.Exited() {
+					log.Error("Daemon dead", zap.String("target", daemon.Name()), zap.Int("exit-status", status.ExitStatus()))
+					return status.ExitStatus(), reason
 				}
 			}
-		}(daemon)
+		}
+		log.Error("Failed to wait daemon", zap.String("target", daemon.Name()), zap.Error(err))
+		return -1, reason
+	}
+	log.Warn("Daemon exited", zap.String("target", daemon.Name()))
+	return 0, reason
+}
+
+// watchReadiness runs the readiness check of the daemon periodically until ctx is done,
+// and makes the daemon ready or unhealthy by the result.
+func (r *Runner) watchReadiness(ctx context.Context, daemon *ServiceTarget) {
+	log := zap.L()
+	check := daemon.readiness
+	for {
+		err := check.run(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		state := daemon.Status().State
+		if err == nil && state != DaemonReady {
+			log.Info("Daemon is ready", zap.String("target", daemon.Name()))
+			daemon.setState(DaemonReady)
+		} else if err != nil && state == DaemonReady {
+			log.Warn("Daemon became unhealthy", zap.String("target", daemon.Name()), zap.Error(err))
+			daemon.setState(DaemonUnhealthy)
+		}
+		timer := time.NewTimer(check.config.Interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
 	}
-	wg.Wait()
+}
+
+// watchLiveness runs the liveness check of the daemon periodically until ctx is done.
+// It returns false when the check failed failure_threshold times in a row, to restart the daemon.
+// Failures are not counted while the daemon is starting, not ready yet.
+func (r *Runner) watchLiveness(ctx context.Context, daemon *ServiceTarget) bool {
+	log := zap.L()
+	check := daemon.liveness
+	failures := 0
+	for {
+		timer := time.NewTimer(check.config.Interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return true
+		case <-timer.C:
+		}
+		if daemon.Status().State == DaemonStarting {
+			failures = 0
+			continue
+		}
+		err := check.run(ctx)
+		if ctx.Err() != nil {
+			return true
+		}
+		if err == nil {
+			failures = 0
+			continue
+		}
+		failures++
+		log.Warn("Daemon failed liveness check",
+			zap.String("target", daemon.Name()),
+			zap.Int("failures", failures),
+			zap.Error(err))
+		if failures >= check.config.FailureThreshold {
+			log.Error("Daemon is not alive, restarting",
+				zap.String("target", daemon.Name()),
+				zap.Int("failures", failures),
+				zap.Error(err))
+			return false
+		}
+	}
+}
+
+// Run blocks until Shutdown is called and all the jobs stop.
+func (r *Runner) Run() error {
+	<-r.context.Done()
+	r.wg.Wait()
 	return nil
 }
 
+// Shutdown stops all the jobs, and waits for the daemons to exit.
 func (r *Runner) Shutdown() {
+	r.mutex.Lock()
 	r.halted.Store(true)
 	r.cancel()
-	r.cron.Stop()
+	r.mutex.Unlock()
+	r.wg.Wait()
 }
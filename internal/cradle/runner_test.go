@@ -0,0 +1,123 @@
+package cradle
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// slowToStop is a daemon which takes 500ms to exit after SIGTERM.
+const slowToStop = `service:
+  path: '/bin/sh'
+  args: ['-c', 'trap "sleep 0.5; exit 0" TERM; echo started; while :; do sleep 0.05; done']
+`
+
+// waitForState waits until the daemon gets into the state.
+func waitForState(t *testing.T, daemon *ServiceTarget, state DaemonState) {
+	waitFor(t, 10*time.Second, "the daemon to be "+string(state), func() bool {
+		return daemon.Status().State == state
+	})
+}
+
+func TestRunnerUpdateStopsJobsAtOnce(t *testing.T) {
+	cradle, config := newTestCradle(t, map[string]string{
+		"a.yml": slowToStop,
+		"b.yml": slowToStop,
+	})
+	for _, name := range []string{"a", "b"} {
+		daemon := cradle.Targets()[name].(*ServiceTarget)
+		waitForState(t, daemon, DaemonRunning)
+		waitFor(t, 5*time.Second, "the trap to be set", func() bool {
+			return len(daemon.stdout.Lines()) > 0
+		})
+		if err := os.Remove(filepath.Join(config.IncludeDirs[0], name+".yml")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	begin := time.Now()
+	if err := cradle.Reload(config); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed < 500*time.Millisecond || 900*time.Millisecond < elapsed {
+		t.Errorf("Daemons must be stopped at once: %v", elapsed)
+	}
+	if len(cradle.Runner().jobs) != 0 {
+		t.Errorf("Jobs of the removed targets must be gone: %v", cradle.Runner().jobs)
+	}
+}
+
+func TestRunnerGivesUpCrashLoopingDaemon(t *testing.T) {
+	cradle, _ := newTestCradle(t, map[string]string{
+		"limited.yml": `service:
+  path: '/bin/sh'
+  args: ['-c', 'exit 3']
+  restart: {initial_backoff: '10ms', max_backoff: '10ms', jitter: 0, max_restarts: 3, window: '1m'}
+`,
+		"unlimited.yml": `service:
+  path: '/bin/sh'
+  args: ['-c', 'exit 3']
+  restart: {initial_backoff: '10ms', max_backoff: '10ms', jitter: 0}
+`,
+	})
+	limited := cradle.Targets()["limited"].(*ServiceTarget)
+	unlimited := cradle.Targets()["unlimited"].(*ServiceTarget)
+	waitForState(t, limited, DaemonFailed)
+	status := limited.Status()
+	if status.Restarts != 3 || status.LastExitCode != 3 {
+		t.Errorf("Daemon must be restarted 3 times before giving up: %+v", status)
+	}
+	waitFor(t, 5*time.Second, "the unlimited daemon to keep restarting", func() bool {
+		return unlimited.Status().Restarts > 5
+	})
+	if status := limited.Status(); status.State != DaemonFailed || status.Restarts != 3 {
+		t.Errorf("Failed daemon must not be restarted any more: %+v", status)
+	}
+}
+
+func TestRunnerRestartsDaemonNotAlive(t *testing.T) {
+	dir := t.TempDir()
+	// The liveness check appends a line to the file every time it runs,
+	// and fails always, or only the first 2 times.
+	daemon := func(check string) string {
+		return `service:
+  path: '/bin/sh'
+  args: ['-c', 'while :; do sleep 0.05; done']
+  restart: {initial_backoff: '10ms', max_backoff: '10ms'}
+  liveness:
+    command: ['/bin/sh', '-c', '` + check + `']
+    interval: '20ms'
+    failure_threshold: 3
+`
+	}
+	dead := filepath.Join(dir, "dead")
+	flaky := filepath.Join(dir, "flaky")
+	cradle, _ := newTestCradle(t, map[string]string{
+		"dead.yml":  daemon("echo >> " + dead + "; exit 1"),
+		"flaky.yml": daemon("echo >> " + flaky + "; test $(wc -l < " + flaky + ") -gt 2"),
+	})
+	c := cradle.metrics
+	lines := func(path string) int {
+		content, _ := ioutil.ReadFile(path)
+		return strings.Count(string(content), "\n")
+	}
+	waitFor(t, 10*time.Second, "the dead daemon to be restarted", func() bool {
+		return testutil.ToFloat64(c.daemonRestarts.WithLabelValues("dead", restartReasonLiveness)) >= 1
+	})
+	if n := lines(dead); n < 3 {
+		t.Errorf("Daemon must be restarted after 3 failures in a row, but %d", n)
+	}
+	if n := testutil.ToFloat64(c.daemonRestarts.WithLabelValues("dead", restartReasonExited)); n != 0 {
+		t.Errorf("Restarts by liveness must not be counted as exited: %v", n)
+	}
+	waitFor(t, 10*time.Second, "the flaky daemon to be checked", func() bool {
+		return lines(flaky) >= 6
+	})
+	if status := cradle.Targets()["flaky"].(*ServiceTarget).Status(); status.Restarts != 0 {
+		t.Errorf("Daemon must not be restarted by less failures than the threshold: %+v", status)
+	}
+}
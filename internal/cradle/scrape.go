@@ -3,70 +3,180 @@ package cradle
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"strings"
+	"sync"
 
+	"github.com/prometheus/common/expfmt"
 	"go.uber.org/zap"
 )
 
-func scrapeEndpoint(ctx context.Context, w io.Writer, configFilePath string, endpoint string) {
+// maxErrorBodySize is the max size of the body of error responses to be shown.
+const maxErrorBodySize = 4096
+
+// scrapeEndpoints scrapes all the endpoints concurrently, at most probe.max_concurrency at once,
+// and writes results in the given order.
+// It returns an error if any of the endpoints failed.
+// client is nil to use the default one.
+func scrapeEndpoints(ctx context.Context, w io.Writer, targetName string, client *http.Client, endpoints []string) error {
+	if len(endpoints) == 1 {
+		// No need to buffer for ordering.
+		if err := scrapeEndpoint(ctx, w, targetName, client, endpoints[0]); err != nil {
+			return fmt.Errorf("%s: %v", endpoints[0], err)
+		}
+		return nil
+	}
+	buffs := make([]bytes.Buffer, len(endpoints))
+	outs := make([]io.Writer, len(endpoints))
+	// The buffers share the limit of the target, so that they never hold more than it in total,
+	// and the other endpoints stop once it is reached.
+	lw, limited := w.(*limitWriter)
+	for idx := range buffs {
+		outs[idx] = &buffs[idx]
+		if limited {
+			outs[idx] = lw.share(&buffs[idx])
+		}
+	}
+	errs := make([]error, len(endpoints))
+	workers := len(endpoints)
+	if n, ok := ctx.Value(maxConcurrencyKey{}).(int); ok && 0 < n && n < workers {
+		workers = n
+	}
+	semaphore := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for idx, endpoint := range endpoints {
+		wg.Add(1)
+		go func(idx int, endpoint string) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			if err := scrapeEndpoint(ctx, outs[idx], targetName, client, endpoint); err != nil {
+				errs[idx] = fmt.Errorf("%s: %v", endpoint, err)
+			}
+		}(idx, endpoint)
+	}
+	wg.Wait()
+	if limited {
+		// Written to the buffers through the shared limit already.
+		w = lw.w
+	}
+	for idx := range buffs {
+		if out, ok := outs[idx].(*limitWriter); ok && out.exceeded {
+			// Drop the last line, which may be cut in the middle.
+			buffs[idx].Truncate(bytes.LastIndexByte(buffs[idx].Bytes(), '\n') + 1)
+		}
+		startSection(w)
+		_, _ = buffs[idx].WriteTo(w)
+	}
+	return combineErrors(errs)
+}
+
+func scrapeEndpoint(ctx context.Context, w io.Writer, targetName string, client *http.Client, endpoint string) error {
 	log := zap.L()
-	var client http.Client
-	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if client == nil {
+		client = defaultEndpointClient
+	}
+	startSection(w)
+	req, err := newEndpointRequest(ctx, endpoint)
 	if err != nil {
-		log.Error("Failed to create request", zap.String("config-file-path", configFilePath), zap.String("endpoint", endpoint), zap.Error(err))
+		log.Error("Failed to create request", zap.String("target", targetName), zap.String("endpoint", endpoint), zap.Error(err))
 		_, _ = io.WriteString(w, "### Scraping Target\n")
 		_, _ = io.WriteString(w, "### Err: Failed to create request\n")
 		_, _ = io.WriteString(w, "### URL: "+endpoint+"\n")
-		_, _ = io.WriteString(w, "### Config: "+configFilePath+"\n")
+		_, _ = io.WriteString(w, "### Target: "+targetName+"\n")
 		_, _ = io.WriteString(w, promCommentOut(err.Error()))
-		return
+		return err
 	}
+	// Setting it ourselves keeps the transport from decompressing gzip by itself, so decodeBody does it.
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	req.Header.Set("Accept", acceptHeader)
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Error("Failed to execute request", zap.String("config-file-path", configFilePath), zap.String("endpoint", endpoint), zap.Error(err))
+		log.Error("Failed to execute request", zap.String("target", targetName), zap.String("endpoint", endpoint), zap.Error(err))
 		_, _ = io.WriteString(w, "### Scraping Target\n")
 		_, _ = io.WriteString(w, "### Err: Failed to execute request\n")
 		_, _ = io.WriteString(w, "### URL: "+endpoint+"\n")
-		_, _ = io.WriteString(w, "### Config: "+configFilePath+"\n")
+		_, _ = io.WriteString(w, "### Target: "+targetName+"\n")
 		_, _ = io.WriteString(w, promCommentOut(err.Error()))
-		return
+		return err
 	}
 	defer func() {
 		err := resp.Body.Close()
 		if err != nil {
-			log.Warn("Failed to close response body", zap.String("config-file-path", configFilePath), zap.String("endpoint", endpoint), zap.Error(err))
+			log.Warn("Failed to close response body", zap.String("target", targetName), zap.String("endpoint", endpoint), zap.Error(err))
 		}
 	}()
-	var buf bytes.Buffer
-	written, err := io.Copy(&buf, resp.Body)
+	limit, _ := ctx.Value(bodySizeLimitKey{}).(ByteSize)
+	body, err := decodeBody(resp, limit)
 	if err != nil {
-		log.Error("Failed to read response body", zap.String("config-file-path", configFilePath), zap.String("endpoint", endpoint), zap.Error(err))
+		log.Error("Failed to decode response body", zap.String("target", targetName), zap.String("endpoint", endpoint), zap.Error(err))
 		_, _ = io.WriteString(w, "### Scraping Target\n")
-		_, _ = io.WriteString(w, "### Err: Failed to read response body\n")
+		_, _ = io.WriteString(w, "### Err: Failed to decode response body\n")
 		_, _ = io.WriteString(w, "### URL: "+endpoint+"\n")
-		_, _ = io.WriteString(w, "### Config: "+configFilePath+"\n")
+		_, _ = io.WriteString(w, "### Target: "+targetName+"\n")
 		_, _ = io.WriteString(w, promCommentOut(err.Error()))
+		return err
 	}
-	if written != resp.ContentLength && resp.ContentLength >= 0 {
-		log.Warn("Body length does not match to content-length header",
-			zap.String("config-file-path", configFilePath),
-			zap.String("endpoint", endpoint),
-			zap.Int64("written", written),
-			zap.Int64("content-length", resp.ContentLength))
-	}
+	defer func() {
+		_ = body.Close()
+	}()
 	if resp.StatusCode < 200 || 300 <= resp.StatusCode {
-		log.Error("Failed to execute request", zap.String("config-file-path", configFilePath), zap.String("endpoint", endpoint), zap.Error(err))
+		log.Error("Failed to execute request", zap.String("target", targetName), zap.String("endpoint", endpoint), zap.Int("status", resp.StatusCode))
+		errBody, _ := ioutil.ReadAll(io.LimitReader(body, maxErrorBodySize))
 		_, _ = io.WriteString(w, "### Scraping Target\n")
 		_, _ = io.WriteString(w, fmt.Sprintf("### Err: Server returns error code: %d\n", resp.StatusCode))
 		_, _ = io.WriteString(w, "### URL: "+endpoint+"\n")
-		_, _ = io.WriteString(w, "### Config: "+configFilePath+"\n")
-		_, _ = io.WriteString(w, promCommentOut(buf.String()))
-		return
+		_, _ = io.WriteString(w, "### Target: "+targetName+"\n")
+		_, _ = io.WriteString(w, promCommentOut(string(errBody)))
+		return fmt.Errorf("server returns error code: %d", resp.StatusCode)
 	}
 	_, _ = io.WriteString(w, "### Scraping Target\n")
 	_, _ = io.WriteString(w, "### URL: "+endpoint+"\n")
-	_, _ = io.WriteString(w, "### Config: "+configFilePath+"\n")
-	_, _ = w.Write(buf.Bytes())
+	_, _ = io.WriteString(w, "### Target: "+targetName+"\n")
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == expfmt.OpenMetricsType {
+		_, _ = io.WriteString(w, openMetricsBanner+"\n")
+	}
+	// Stream the body, not to hold it twice.
+	written, err := io.Copy(w, body)
+	if err != nil {
+		log.Error("Failed to read response body", zap.String("target", targetName), zap.String("endpoint", endpoint), zap.Error(err))
+		_, _ = io.WriteString(w, "\n### Scraping Target\n")
+		_, _ = io.WriteString(w, "### Err: Failed to read response body\n")
+		_, _ = io.WriteString(w, "### URL: "+endpoint+"\n")
+		_, _ = io.WriteString(w, "### Target: "+targetName+"\n")
+		_, _ = io.WriteString(w, promCommentOut(err.Error()))
+		return err
+	}
+	// Content-Length is the size of the compressed body if it is compressed.
+	if written != resp.ContentLength && resp.ContentLength >= 0 && len(resp.Header.Get("Content-Encoding")) == 0 {
+		log.Warn("Body length does not match to content-length header",
+			zap.String("target", targetName),
+			zap.String("endpoint", endpoint),
+			zap.Int64("written", written),
+			zap.Int64("content-length", resp.ContentLength))
+	}
+	return nil
+}
+
+// combineErrors returns an error which describes all the non-nil errors, or nil if there is none.
+func combineErrors(errs []error) error {
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		if err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	switch len(msgs) {
+	case 0:
+		return nil
+	case 1:
+		return errors.New(msgs[0])
+	default:
+		return fmt.Errorf("%d errors occurred: %s", len(msgs), strings.Join(msgs, "; "))
+	}
 }
@@ -0,0 +1,52 @@
+package cradle
+
+import (
+	"bytes"
+	"io"
+)
+
+// sectionStarter is implemented by writers which keep the output of each sub-scrape of a target
+// (an endpoint, a file, a script run) apart.
+type sectionStarter interface {
+	startSection()
+}
+
+// startSection tells w that a new sub-scrape begins, if w keeps them apart.
+// Sub-scrapes call it before writing their banner.
+func startSection(w io.Writer) {
+	if s, ok := w.(sectionStarter); ok {
+		s.startSection()
+	}
+}
+
+// sectionWriter collects the output of a target, split into sections by startSection.
+// Each section is parsed on its own, because two endpoints of one target may
+// legitimately expose the same metric family.
+type sectionWriter struct {
+	buffs []*bytes.Buffer
+}
+
+func (sw *sectionWriter) Write(p []byte) (int, error) {
+	if len(sw.buffs) == 0 {
+		sw.startSection()
+	}
+	return sw.buffs[len(sw.buffs)-1].Write(p)
+}
+
+func (sw *sectionWriter) startSection() {
+	if n := len(sw.buffs); n > 0 && sw.buffs[n-1].Len() == 0 {
+		return
+	}
+	sw.buffs = append(sw.buffs, &bytes.Buffer{})
+}
+
+// sections returns the output written so far, one for each section.
+func (sw *sectionWriter) sections() [][]byte {
+	sections := make([][]byte, 0, len(sw.buffs))
+	for _, section := range sw.buffs {
+		if section.Len() > 0 {
+			sections = append(sections, section.Bytes())
+		}
+	}
+	return sections
+}
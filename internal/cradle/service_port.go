@@ -0,0 +1,96 @@
+package cradle
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+)
+
+// allocatePort returns the port of the daemon, picking a free one for "auto".
+// When only checking the config, no port is picked for "auto", and 0 is returned instead.
+// 0 is returned when no port is set.
+func (cfg *ServiceConfig) allocatePort(check bool) (int, error) {
+	switch cfg.Port {
+	case "":
+		return 0, nil
+	case "auto":
+		if check {
+			return 0, nil
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return 0, fmt.Errorf("failed to allocate port: %v", err)
+		}
+		defer func() {
+			_ = listener.Close()
+		}()
+		return listener.Addr().(*net.TCPAddr).Port, nil
+	default:
+		port, err := strconv.Atoi(cfg.Port)
+		if err != nil || port <= 0 || 65535 < port {
+			return 0, fmt.Errorf("port must be \"auto\" or a port number: %s", cfg.Port)
+		}
+		return port, nil
+	}
+}
+
+// portPlaceholder matches "{{ .Port }}", with or without the spaces, which is replaced with the port of the daemon.
+// It is not a template, so that other braces in args and env are left as they are.
+var portPlaceholder = regexp.MustCompile(`\{\{\s*\.Port\s*\}\}`)
+
+// unknownPortPlaceholder matches other actions with .Port, like "{{- .Port }}", which would be passed to the daemon as they are.
+var unknownPortPlaceholder = regexp.MustCompile(`\{\{[^}]*\.Port\b`)
+
+// withPort returns a copy of the config, with "{{ .Port }}" replaced with the port.
+// The config is returned as is when no port is set.
+func (cfg *ServiceConfig) withPort(port int) (*ServiceConfig, error) {
+	if len(cfg.Port) == 0 {
+		return cfg, nil
+	}
+	portText := strconv.Itoa(port)
+	var err error
+	render := func(text string) string {
+		text = portPlaceholder.ReplaceAllLiteralString(text, portText)
+		if unknownPortPlaceholder.MatchString(text) && err == nil {
+			err = fmt.Errorf("port must be written as {{ .Port }}: %q", text)
+		}
+		return text
+	}
+	renderAll := func(texts []string) []string {
+		if texts == nil {
+			return nil
+		}
+		rendered := make([]string, len(texts))
+		for idx, text := range texts {
+			rendered[idx] = render(text)
+		}
+		return rendered
+	}
+	renderCheck := func(check *HealthCheckConfig) *HealthCheckConfig {
+		if check == nil {
+			return nil
+		}
+		c := *check
+		c.HTTP = render(c.HTTP)
+		c.TCP = render(c.TCP)
+		c.Command = renderAll(c.Command)
+		return &c
+	}
+
+	c := *cfg
+	c.Args = renderAll(cfg.Args)
+	c.Endpoints = renderAll(cfg.Endpoints)
+	if cfg.Env != nil {
+		c.Env = make(map[string]string, len(cfg.Env))
+		for name, value := range cfg.Env {
+			c.Env[name] = render(value)
+		}
+	}
+	c.Readiness = renderCheck(cfg.Readiness)
+	c.Liveness = renderCheck(cfg.Liveness)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
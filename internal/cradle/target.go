@@ -1,12 +1,20 @@
 package cradle
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
 
+	"github.com/prometheus/common/model"
+	"github.com/robfig/cron"
 	"gopkg.in/yaml.v2"
 )
 
-func newTargets(config *Config) (map[string]Target, error) {
+// newTargets makes the targets in the include dirs.
+// check is true when the config is only checked; then no resource like a port is taken for them.
+func newTargets(config *Config, check bool) (map[string]Target, error) {
 	configs := make(map[string]*TargetConfig)
 	for _, dir := range config.IncludeDirs {
 		if err := collectTargetConfigsFromDir(dir, configs); err != nil {
@@ -14,8 +22,26 @@ func newTargets(config *Config) (map[string]Target, error) {
 		}
 	}
 	targets := make(map[string]Target)
-	for fpath, cfg := range configs {
-		target := newTarget(cfg)
+	for name, cfg := range configs {
+		for label := range cfg.Labels {
+			if !model.LabelName(label).IsValid() {
+				return nil, fmt.Errorf("invalid label name in %s: %q", cfg.ConfigFilePath, label)
+			}
+			if strings.HasPrefix(label, model.ReservedLabelPrefix) {
+				return nil, fmt.Errorf("reserved label name in %s: %q", cfg.ConfigFilePath, label)
+			}
+			if label == TargetLabelName {
+				return nil, fmt.Errorf("label %q is set by cradle and cannot be overridden in %s", label, cfg.ConfigFilePath)
+			}
+		}
+		if cfg.BodySizeLimit <= 0 {
+			cfg.BodySizeLimit = config.Probe.BodySizeLimit
+		}
+		cfg.fileDigests = digestFiles(cfg.filesReadOnce())
+		target, err := newTarget(cfg, check)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config in %s: %v", cfg.ConfigFilePath, err)
+		}
 		if target == nil {
 			yamlBytes, err := yaml.Marshal(cfg)
 			if err != nil {
@@ -23,36 +49,106 @@ func newTargets(config *Config) (map[string]Target, error) {
 			}
 			return nil, fmt.Errorf("invalid config(unknown target type): \n%s", string(yamlBytes))
 		}
-		targets[fpath] = target
+		targets[name] = target
 	}
 	return targets, nil
 }
 
 //---
 
-func newTarget(cfg *TargetConfig) Target {
+var targetTypes = []string{"static", "cron", "script", "service", "exporter"}
+
+// targetType returns the type of the target, as written in config files.
+func targetType(target Target) string {
+	switch target.(type) {
+	case *StaticFileTarget:
+		return "static"
+	case *CronJobTarget:
+		return "cron"
+	case *ScriptTarget:
+		return "script"
+	case *ServiceTarget:
+		return "service"
+	case *ExporterTarget, *EndpointTarget:
+		return "exporter"
+	default:
+		return "unknown"
+	}
+}
+
+func newTarget(cfg *TargetConfig, check bool) (Target, error) {
 	switch {
 	case cfg.StaticConfig != nil:
 		return &StaticFileTarget{
 			Config: cfg,
-		}
+		}, nil
 	case cfg.CronJobConfig != nil:
-		return &CronJobTarget{
-			Config: cfg,
+		proc, err := newProcess(cfg.Name, &cfg.CronJobConfig.ProcessConfig)
+		if err != nil {
+			return nil, err
 		}
+		schedule, err := cron.Parse(cfg.CronJobConfig.Every)
+		if err != nil {
+			return nil, err
+		}
+		return &CronJobTarget{
+			Config:   cfg,
+			schedule: schedule,
+			process:  proc,
+		}, nil
 	case cfg.ScriptConfig != nil:
-		return &ScriptTarget{
-			Config: cfg,
+		proc, err := newProcess(cfg.Name, &cfg.ScriptConfig.ProcessConfig)
+		if err != nil {
+			return nil, err
 		}
+		return &ScriptTarget{
+			Config:  cfg,
+			process: proc,
+		}, nil
 	case cfg.ServiceConfig != nil:
-		return &ServiceTarget{
-			Config: cfg,
-		}
+		return newServiceTarget(cfg, check)
 	case cfg.ExporterConfig != nil:
+		client, err := newHTTPClient(cfg.ExporterConfig.HTTPClient)
+		if err != nil {
+			return nil, err
+		}
 		return &ExporterTarget{
 			Config: cfg,
-		}
+			client: client,
+		}, nil
 	default:
-		return nil
+		return nil, nil
+	}
+}
+
+// reuseUnchangedTargets replaces new targets with old ones if their configs are the same,
+// so that their daemons, schedules and caches survive reloading.
+func reuseUnchangedTargets(oldTargets map[string]Target, newTargets map[string]Target) {
+	for name, newTarget := range newTargets {
+		oldTarget, ok := oldTargets[name]
+		if ok && sameTargetConfig(oldTarget.TargetConfig(), newTarget.TargetConfig()) {
+			newTargets[name] = oldTarget
+		}
 	}
 }
+
+// digestFiles hashes the contents of the files. Files which cannot be read are left out.
+func digestFiles(paths []string) map[string][sha256.Size]byte {
+	digests := make(map[string][sha256.Size]byte, len(paths))
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		digests[path] = sha256.Sum256(content)
+	}
+	return digests
+}
+
+// sameTargetConfig compares two target configs, ignoring where they are written.
+// The contents of the files read only once are compared as well.
+func sameTargetConfig(a *TargetConfig, b *TargetConfig) bool {
+	ca, cb := *a, *b
+	ca.ConfigFilePath, cb.ConfigFilePath = "", ""
+	return reflect.DeepEqual(ca, cb)
+}
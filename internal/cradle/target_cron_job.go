@@ -4,42 +4,71 @@ import (
 	"bytes"
 	"context"
 	"io"
-	"os/exec"
+	"sync"
 
+	"github.com/robfig/cron"
 	"go.uber.org/zap"
 )
 
 type CronJobTarget struct {
 	Config     *TargetConfig
+	mutex      sync.Mutex
 	lastResult []byte
+	lastErr    error
+	schedule   cron.Schedule
+	process    *process
 }
 
-func (target *CronJobTarget) Scrape(ctx context.Context, w io.Writer) {
+func (target *CronJobTarget) Scrape(ctx context.Context, w io.Writer) error {
 	log := zap.L()
-	if target.lastResult == nil {
+	startSection(w)
+	target.mutex.Lock()
+	lastResult, lastErr := target.lastResult, target.lastErr
+	target.mutex.Unlock()
+	if lastResult == nil {
 		err := target.update(ctx)
 		if err != nil {
-			log.Error("Err: Failed to update target (on the fly)", zap.Error(err))
+			log.Error("Err: Failed to update target (on the fly)", zap.String("target", target.Name()), zap.Error(err))
 			_, _ = io.WriteString(w, "### Cron Job Target\n")
 			_, _ = io.WriteString(w, "### Err: Failed to execute target (on the fly)\n")
-			_, _ = io.WriteString(w, "### Config: "+target.ConfigFilePath()+"\n")
+			_, _ = io.WriteString(w, "### Target: "+target.Name()+"\n")
 			_, _ = io.WriteString(w, promCommentOut(err.Error()))
-			return
+			return err
 		}
+		target.mutex.Lock()
+		lastResult, lastErr = target.lastResult, target.lastErr
+		target.mutex.Unlock()
 	}
 	_, _ = io.WriteString(w, "### Cron Job Target\n")
-	_, _ = io.WriteString(w, "### Config: "+target.ConfigFilePath()+"\n")
-	_, err := w.Write(target.lastResult)
+	if lastErr != nil {
+		// Keep exposing the last successful result, but tell the last execution failed.
+		_, _ = io.WriteString(w, "### Err: Last execution failed\n")
+		_, _ = io.WriteString(w, "### Target: "+target.Name()+"\n")
+		_, _ = io.WriteString(w, promCommentOut(lastErr.Error()))
+	} else {
+		_, _ = io.WriteString(w, "### Target: "+target.Name()+"\n")
+	}
+	_, err := w.Write(lastResult)
 	if err != nil {
-		log.Error("Failed to write out last result (on the fly)", zap.Error(err))
+		log.Error("Failed to write out last result (on the fly)", zap.String("target", target.Name()), zap.Error(err))
 	}
+	return lastErr
 }
 
 func (target *CronJobTarget) update(ctx context.Context) error {
-	cmd := exec.CommandContext(ctx, target.Config.CronJobConfig.Path, target.Config.CronJobConfig.Args...)
 	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
+	cmd, err := target.process.command()
+	if err == nil {
+		lw := newLimitWriter(&out, target.Config.BodySizeLimit)
+		cmd.Stdout = lw
+		err = target.process.run(ctx, cmd)
+		if lw.exceeded {
+			err = errBodySizeLimit
+		}
+	}
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+	target.lastErr = err
 	if err != nil {
 		return err
 	}
@@ -47,6 +76,14 @@ func (target *CronJobTarget) update(ctx context.Context) error {
 	return nil
 }
 
+func (target *CronJobTarget) Name() string {
+	return target.Config.Name
+}
+
 func (target *CronJobTarget) ConfigFilePath() string {
 	return target.Config.ConfigFilePath
 }
+
+func (target *CronJobTarget) TargetConfig() *TargetConfig {
+	return target.Config
+}
@@ -3,18 +3,32 @@ package cradle
 import (
 	"context"
 	"io"
+	"net/http"
 )
 
 type EndpointTarget struct {
 	Config *TargetConfig
+	client *http.Client
 }
 
-func (target *EndpointTarget) Scrape(ctx context.Context, w io.Writer) {
-	for _, endpoint := range target.Config.ExporterConfig.Endpoints {
-		scrapeEndpoint(ctx, w, target.Config.ConfigFilePath, endpoint)
+func (target *EndpointTarget) Scrape(ctx context.Context, w io.Writer) error {
+	return scrapeEndpoints(ctx, w, target.Name(), target.client, target.Config.ExporterConfig.Endpoints)
+}
+
+func (target *EndpointTarget) closeIdleConnections() {
+	if target.client != nil {
+		target.client.CloseIdleConnections()
 	}
 }
 
+func (target *EndpointTarget) Name() string {
+	return target.Config.Name
+}
+
 func (target *EndpointTarget) ConfigFilePath() string {
 	return target.Config.ConfigFilePath
 }
+
+func (target *EndpointTarget) TargetConfig() *TargetConfig {
+	return target.Config
+}
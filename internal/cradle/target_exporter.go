@@ -3,18 +3,32 @@ package cradle
 import (
 	"context"
 	"io"
+	"net/http"
 )
 
 type ExporterTarget struct {
 	Config *TargetConfig
+	client *http.Client
 }
 
-func (target *ExporterTarget) Scrape(ctx context.Context, w io.Writer) {
-	for _, endpoint := range target.Config.ExporterConfig.Endpoints {
-		scrapeEndpoint(ctx, w, target.Config.ConfigFilePath, endpoint)
+func (target *ExporterTarget) Scrape(ctx context.Context, w io.Writer) error {
+	return scrapeEndpoints(ctx, w, target.Name(), target.client, target.Config.ExporterConfig.Endpoints)
+}
+
+func (target *ExporterTarget) closeIdleConnections() {
+	if target.client != nil {
+		target.client.CloseIdleConnections()
 	}
 }
 
+func (target *ExporterTarget) Name() string {
+	return target.Config.Name
+}
+
 func (target *ExporterTarget) ConfigFilePath() string {
 	return target.Config.ConfigFilePath
 }
+
+func (target *ExporterTarget) TargetConfig() *TargetConfig {
+	return target.Config
+}
@@ -1,33 +1,52 @@
 package cradle
 
 import (
-	"bytes"
 	"context"
 	"io"
-	"os/exec"
 )
 
 type ScriptTarget struct {
-	Config *TargetConfig
+	Config  *TargetConfig
+	process *process
 }
 
-func (target *ScriptTarget) Scrape(ctx context.Context, w io.Writer) {
-	cmd := exec.CommandContext(ctx, target.Config.ScriptConfig.Path, target.Config.ScriptConfig.Args...)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
+func (target *ScriptTarget) Scrape(ctx context.Context, w io.Writer) error {
+	startSection(w)
+	cmd, err := target.process.command()
 	if err != nil {
 		_, _ = io.WriteString(w, "### Script File Target\n")
 		_, _ = io.WriteString(w, "### Err: Failed to execute script\n")
-		_, _ = io.WriteString(w, "### Config: "+target.ConfigFilePath()+"\n")
+		_, _ = io.WriteString(w, "### Target: "+target.Name()+"\n")
 		_, _ = io.WriteString(w, promCommentOut(err.Error()))
-		return
+		return err
 	}
 	_, _ = io.WriteString(w, "### Script File Target\n")
-	_, _ = io.WriteString(w, "### Config: "+target.ConfigFilePath()+"\n")
-	_, _ = io.Copy(w, &out)
+	_, _ = io.WriteString(w, "### Target: "+target.Name()+"\n")
+	// Stream the output, not to hold it twice. w stops it at body_size_limit, and the output is kept up to there.
+	cmd.Stdout = w
+	err = target.process.run(ctx, cmd)
+	if lw, ok := w.(*limitWriter); ok && lw.limitExceeded() {
+		// The script may be killed by SIGPIPE; tell why. The marker is added by scrapeTarget.
+		return errBodySizeLimit
+	}
+	if err != nil {
+		_, _ = io.WriteString(w, "\n### Script File Target\n")
+		_, _ = io.WriteString(w, "### Err: Failed to execute script\n")
+		_, _ = io.WriteString(w, "### Target: "+target.Name()+"\n")
+		_, _ = io.WriteString(w, promCommentOut(err.Error()))
+		return err
+	}
+	return nil
+}
+
+func (target *ScriptTarget) Name() string {
+	return target.Config.Name
 }
 
 func (target *ScriptTarget) ConfigFilePath() string {
 	return target.Config.ConfigFilePath
 }
+
+func (target *ScriptTarget) TargetConfig() *TargetConfig {
+	return target.Config
+}
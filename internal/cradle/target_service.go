@@ -2,19 +2,190 @@ package cradle
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap/zapcore"
 )
 
+type DaemonState string
+
+const (
+	// DaemonStarting means it is starting, or not ready yet if it has a readiness check.
+	DaemonStarting DaemonState = "starting"
+	// DaemonRunning means it is running, and it has no readiness check.
+	DaemonRunning DaemonState = "running"
+	// DaemonReady means it passed its readiness check.
+	DaemonReady DaemonState = "ready"
+	// DaemonUnhealthy means it was once ready, but fails its readiness check now.
+	DaemonUnhealthy DaemonState = "unhealthy"
+	DaemonBackoff   DaemonState = "backoff"
+	DaemonFailed    DaemonState = "failed"
+	DaemonStopped   DaemonState = "stopped"
+)
+
+var daemonStates = []DaemonState{DaemonStarting, DaemonRunning, DaemonReady, DaemonUnhealthy, DaemonBackoff, DaemonFailed, DaemonStopped}
+
+// DaemonStatus tells how the daemon of a ServiceTarget is doing.
+type DaemonStatus struct {
+	State        DaemonState
+	Since        time.Time
+	Restarts     int
+	LastExitCode int
+}
+
 type ServiceTarget struct {
 	Config *TargetConfig
+	// service is Config.ServiceConfig with the port substituted.
+	service *ServiceConfig
+	port    int
+	mutex   sync.Mutex
+	status  DaemonStatus
+	process *process
+	// client scrapes the endpoints.
+	client *http.Client
+	// readiness and liveness are nil if the daemon has no such check.
+	readiness *healthCheck
+	liveness  *healthCheck
+	// stdout and stderr keep the last lines the daemon wrote, across restarts.
+	stdout *daemonLog
+	stderr *daemonLog
+}
+
+// WriteLogs writes the last lines the daemon wrote to the streams; "stdout", "stderr" or both if empty.
+func (target *ServiceTarget) WriteLogs(w io.Writer, stream string) error {
+	switch stream {
+	case "stdout":
+		return writeDaemonLogs(w, target.stdout)
+	case "stderr":
+		return writeDaemonLogs(w, target.stderr)
+	case "":
+		return writeDaemonLogs(w, target.stdout, target.stderr)
+	default:
+		return fmt.Errorf("unknown stream: %s", stream)
+	}
+}
+
+func newServiceTarget(cfg *TargetConfig, check bool) (*ServiceTarget, error) {
+	port, err := cfg.ServiceConfig.allocatePort(check)
+	if err != nil {
+		return nil, err
+	}
+	service, err := cfg.ServiceConfig.withPort(port)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newHTTPClient(service.HTTPClient)
+	if err != nil {
+		return nil, err
+	}
+	proc, err := newProcess(cfg.Name, &service.ProcessConfig)
+	if err != nil {
+		return nil, err
+	}
+	proc.stopSignal, err = parseStopSignal(service.StopSignal)
+	if err != nil {
+		return nil, err
+	}
+	proc.stopTimeout = service.StopTimeout
+	if proc.stopTimeout <= 0 {
+		proc.stopTimeout = defaultStopTimeout
+	}
+	target := &ServiceTarget{
+		Config:  cfg,
+		service: service,
+		port:    port,
+		process: proc,
+		client:  client,
+		stdout:  newDaemonLog(cfg.Name, "stdout", zapcore.InfoLevel, service.LogLines),
+		stderr:  newDaemonLog(cfg.Name, "stderr", zapcore.ErrorLevel, service.LogLines),
+	}
+	if readiness := service.Readiness; readiness != nil {
+		target.readiness, err = newHealthCheck(cfg.Name, readiness, client, &service.ProcessConfig)
+		if err != nil {
+			return nil, fmt.Errorf("invalid readiness: %v", err)
+		}
+	}
+	if liveness := service.Liveness; liveness != nil {
+		livenessCfg := *liveness
+		if livenessCfg.Interval <= 0 {
+			livenessCfg.Interval = 10 * time.Second
+		}
+		if len(livenessCfg.HTTP) == 0 && len(livenessCfg.TCP) == 0 && len(livenessCfg.Command) == 0 && len(service.Endpoints) > 0 {
+			livenessCfg.HTTP = service.Endpoints[0]
+		}
+		target.liveness, err = newHealthCheck(cfg.Name, &livenessCfg, client, &service.ProcessConfig)
+		if err != nil {
+			return nil, fmt.Errorf("invalid liveness: %v", err)
+		}
+	}
+	return target, nil
+}
+
+// Scrape scrapes the endpoints only while the daemon is running or ready,
+// because otherwise they just refuse connections.
+func (target *ServiceTarget) Scrape(ctx context.Context, w io.Writer) error {
+	if state := target.Status().State; state != DaemonRunning && state != DaemonReady {
+		err := fmt.Errorf("daemon is not ready: %s", state)
+		startSection(w)
+		_, _ = io.WriteString(w, "### Service Target\n")
+		_, _ = io.WriteString(w, "### Err: Daemon is not ready\n")
+		_, _ = io.WriteString(w, "### Target: "+target.Name()+"\n")
+		_, _ = io.WriteString(w, promCommentOut(err.Error()))
+		return err
+	}
+	return scrapeEndpoints(ctx, w, target.Name(), target.client, target.service.Endpoints)
 }
 
-func (target *ServiceTarget) Scrape(ctx context.Context, w io.Writer) {
-	for _, endpoint := range target.Config.ServiceConfig.Endpoints {
-		scrapeEndpoint(ctx, w, target.Config.ConfigFilePath, endpoint)
+// Status returns a snapshot of the daemon status.
+func (target *ServiceTarget) Status() DaemonStatus {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+	status := target.status
+	if len(status.State) == 0 {
+		status.State = DaemonStopped
 	}
+	return status
+}
+
+func (target *ServiceTarget) setState(state DaemonState) {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+	if target.status.State != state {
+		target.status.State = state
+		target.status.Since = time.Now()
+	}
+}
+
+func (target *ServiceTarget) setExited(exitCode int) {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+	target.status.LastExitCode = exitCode
+}
+
+func (target *ServiceTarget) addRestart() {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+	target.status.Restarts++
+}
+
+func (target *ServiceTarget) closeIdleConnections() {
+	if target.client != nil {
+		target.client.CloseIdleConnections()
+	}
+}
+
+func (target *ServiceTarget) Name() string {
+	return target.Config.Name
 }
 
 func (target *ServiceTarget) ConfigFilePath() string {
 	return target.Config.ConfigFilePath
 }
+
+func (target *ServiceTarget) TargetConfig() *TargetConfig {
+	return target.Config
+}
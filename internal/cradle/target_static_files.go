@@ -1,7 +1,6 @@
 package cradle
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -15,25 +14,30 @@ type StaticFileTarget struct {
 	Config *TargetConfig
 }
 
-func (target *StaticFileTarget) Scrape(_ context.Context, w io.Writer) {
+func (target *StaticFileTarget) Scrape(_ context.Context, w io.Writer) error {
+	errs := make([]error, 0)
 	for _, file := range target.Config.StaticConfig.Paths {
-		target.scrapePath(w, file)
+		if err := target.scrapePath(w, file); err != nil {
+			errs = append(errs, err)
+		}
 	}
+	return combineErrors(errs)
 }
 
-func (target *StaticFileTarget) scrapePath(w io.Writer, p string) {
+func (target *StaticFileTarget) scrapePath(w io.Writer, p string) error {
 	log := zap.L()
+	startSection(w)
 	p = filepath.Clean(p)
-	configFilePath := target.ConfigFilePath()
+	name := target.Name()
 	var err error
 	info, err := os.Lstat(p)
 	if err != nil {
 		_, _ = io.WriteString(w, "### Static File Target\n")
 		_, _ = io.WriteString(w, "### Err: Failed to lstat file\n")
 		_, _ = io.WriteString(w, "### Path: "+p+"\n")
-		_, _ = io.WriteString(w, "### Config: "+configFilePath+"\n")
+		_, _ = io.WriteString(w, "### Target: "+name+"\n")
 		_, _ = io.WriteString(w, promCommentOut(err.Error()))
-		return
+		return err
 	}
 	if (info.Mode() & os.ModeSymlink) == os.ModeSymlink {
 		p, err = filepath.EvalSymlinks(p)
@@ -41,11 +45,11 @@ func (target *StaticFileTarget) scrapePath(w io.Writer, p string) {
 			_, _ = io.WriteString(w, "### Static File Target\n")
 			_, _ = io.WriteString(w, "### Err: Failed to eval symlink\n")
 			_, _ = io.WriteString(w, "### Path: "+p+"\n")
-			_, _ = io.WriteString(w, "### Config: "+configFilePath+"\n")
+			_, _ = io.WriteString(w, "### Target: "+name+"\n")
 			_, _ = io.WriteString(w, promCommentOut(err.Error()))
+			return err
 		}
-		target.scrapePath(w, p)
-		return
+		return target.scrapePath(w, p)
 	}
 	if info.Mode().IsRegular() {
 		var written int64
@@ -54,9 +58,9 @@ func (target *StaticFileTarget) scrapePath(w io.Writer, p string) {
 			_, _ = io.WriteString(w, "### Static File Target\n")
 			_, _ = io.WriteString(w, "### Err: Failed to open file\n")
 			_, _ = io.WriteString(w, "### Path: "+p+"\n")
-			_, _ = io.WriteString(w, "### Config: "+configFilePath+"\n")
+			_, _ = io.WriteString(w, "### Target: "+name+"\n")
 			_, _ = io.WriteString(w, promCommentOut(err.Error()))
-			return
+			return err
 		}
 		defer func() {
 			err = file.Close()
@@ -64,23 +68,22 @@ func (target *StaticFileTarget) scrapePath(w io.Writer, p string) {
 				log.Warn("Failed to close file", zap.String("path", p), zap.Error(err))
 			}
 		}()
-		var buff bytes.Buffer
-		written, err = io.Copy(&buff, file)
+		_, _ = io.WriteString(w, "### Static File Target\n")
+		_, _ = io.WriteString(w, "### Path: "+p+"\n")
+		_, _ = io.WriteString(w, "### Target: "+name+"\n")
+		written, err = io.Copy(w, file)
 		if err != nil {
-			_, _ = io.WriteString(w, "### Static File Target\n")
+			_, _ = io.WriteString(w, "\n### Static File Target\n")
 			_, _ = io.WriteString(w, "### Err: Failed to read file\n")
 			_, _ = io.WriteString(w, "### Path: "+p+"\n")
-			_, _ = io.WriteString(w, "### Config: "+configFilePath+"\n")
+			_, _ = io.WriteString(w, "### Target: "+name+"\n")
 			_, _ = io.WriteString(w, promCommentOut(err.Error()))
+			return err
 		}
 		if written != info.Size() {
 			log.Warn("Failed to copy all contents of the file", zap.String("path", p), zap.Int64("size", info.Size()), zap.Int64("written", written))
 		}
-		_, _ = io.WriteString(w, "### Static File Target\n")
-		_, _ = io.WriteString(w, "### Path: "+p+"\n")
-		_, _ = io.WriteString(w, "### Config: "+configFilePath+"\n")
-		_, _ = w.Write(buff.Bytes())
-		return
+		return nil
 	}
 	if (info.Mode() & os.ModeSymlink) == os.ModeSymlink {
 		p, err = filepath.EvalSymlinks(p)
@@ -88,31 +91,42 @@ func (target *StaticFileTarget) scrapePath(w io.Writer, p string) {
 			_, _ = io.WriteString(w, "### Static File Target\n")
 			_, _ = io.WriteString(w, "### Err: Failed to eval symlink\n")
 			_, _ = io.WriteString(w, "### Path: "+p+"\n")
-			_, _ = io.WriteString(w, "### Config: "+configFilePath+"\n")
+			_, _ = io.WriteString(w, "### Target: "+name+"\n")
 			_, _ = io.WriteString(w, promCommentOut(err.Error()))
-			return
+			return err
 		}
-		target.scrapePath(w, p)
-		return
+		return target.scrapePath(w, p)
 	}
 	if info.Mode().IsDir() {
+		errs := make([]error, 0)
 		_ = filepath.Walk(p, func(path string, info os.FileInfo, err error) error {
 			if info.IsDir() {
 				return nil
 			}
-			target.scrapePath(w, path)
+			if err := target.scrapePath(w, path); err != nil {
+				errs = append(errs, err)
+			}
 			return nil
 		})
-		return
+		return combineErrors(errs)
 	}
 	log.Warn("Unknown file type", zap.String("mode", info.Mode().String()))
 	_, _ = io.WriteString(w, "### Static File Target\n")
 	_, _ = io.WriteString(w, "### Err: Unknown file type\n")
 	_, _ = io.WriteString(w, "### Path: "+p+"\n")
-	_, _ = io.WriteString(w, "### Config: "+configFilePath+"\n")
+	_, _ = io.WriteString(w, "### Target: "+name+"\n")
 	_, _ = io.WriteString(w, fmt.Sprintf("### FileType: %s", info.Mode().String()))
+	return fmt.Errorf("unknown file type: path=%s, mode=%s", p, info.Mode().String())
+}
+
+func (target *StaticFileTarget) Name() string {
+	return target.Config.Name
 }
 
 func (target *StaticFileTarget) ConfigFilePath() string {
 	return target.Config.ConfigFilePath
 }
+
+func (target *StaticFileTarget) TargetConfig() *TargetConfig {
+	return target.Config
+}
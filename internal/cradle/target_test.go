@@ -0,0 +1,166 @@
+package cradle
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReuseUnchangedTargets(t *testing.T) {
+	oldTargets := map[string]Target{
+		"same":    &ScriptTarget{Config: &TargetConfig{Name: "same", ConfigFilePath: "/a/same.yml", ScriptConfig: &ScriptConfig{ProcessConfig{Path: "/bin/true"}}}},
+		"changed": &ScriptTarget{Config: &TargetConfig{Name: "changed", ScriptConfig: &ScriptConfig{ProcessConfig{Path: "/bin/true"}}}},
+	}
+	newTargets := map[string]Target{
+		"same":    &ScriptTarget{Config: &TargetConfig{Name: "same", ConfigFilePath: "/b/same.yml", ScriptConfig: &ScriptConfig{ProcessConfig{Path: "/bin/true"}}}},
+		"changed": &ScriptTarget{Config: &TargetConfig{Name: "changed", ScriptConfig: &ScriptConfig{ProcessConfig{Path: "/bin/false"}}}},
+		"added":   &ScriptTarget{Config: &TargetConfig{Name: "added", ScriptConfig: &ScriptConfig{ProcessConfig{Path: "/bin/true"}}}},
+	}
+	reuseUnchangedTargets(oldTargets, newTargets)
+	if newTargets["same"] != oldTargets["same"] {
+		t.Error("Unchanged target must be reused, even if its config file moved")
+	}
+	if newTargets["changed"] == oldTargets["changed"] {
+		t.Error("Changed target must not be reused")
+	}
+}
+
+func TestReuseTargetsWithChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	envFile := filepath.Join(t.TempDir(), "env")
+	writeFile := func(path string, content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(envFile, "FOO=foo\n")
+	writeFile(filepath.Join(dir, "daemon.yml"), "service: {path: /bin/true, env_file: '"+envFile+"'}\n")
+	config := &Config{IncludeDirs: []string{dir}}
+	load := func() map[string]Target {
+		targets, err := newTargets(config, false)
+		if err != nil {
+			t.Fatalf("Failed to make targets: %v", err)
+		}
+		return targets
+	}
+	oldTargets := load()
+	newTargets := load()
+	reuseUnchangedTargets(oldTargets, newTargets)
+	if newTargets["daemon"] != oldTargets["daemon"] {
+		t.Error("Target must be reused if its env file is unchanged")
+	}
+	writeFile(envFile, "FOO=bar\n")
+	newTargets = load()
+	reuseUnchangedTargets(oldTargets, newTargets)
+	if newTargets["daemon"] == oldTargets["daemon"] {
+		t.Error("Target must not be reused if its env file changed")
+	}
+}
+
+func TestNewTargetsWithInvalidLabels(t *testing.T) {
+	for _, labels := range []string{
+		"{cradle_target: other}",
+		"{__name__: other}",
+		"{'invalid-name': value}",
+	} {
+		dir := t.TempDir()
+		content := "labels: " + labels + "\nscript: {path: /bin/true}\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, "node.yml"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newTargets(&Config{IncludeDirs: []string{dir}}, false); err == nil {
+			t.Errorf("Labels must be rejected: %s", labels)
+		}
+	}
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "node.yml"), []byte("labels: {team: infra}\nscript: {path: /bin/true}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newTargets(&Config{IncludeDirs: []string{dir}}, false); err != nil {
+		t.Errorf("Valid labels must be accepted: %v", err)
+	}
+}
+
+func TestNewTargetWithUnknownUser(t *testing.T) {
+	cfg := &TargetConfig{
+		Name:         "script",
+		ScriptConfig: &ScriptConfig{ProcessConfig{Path: "/bin/true", User: "cradle-no-such-user"}},
+	}
+	if _, err := newTarget(cfg, false); err == nil {
+		t.Error("Target with unknown user must be rejected")
+	}
+}
+
+func TestServiceTargetNotReady(t *testing.T) {
+	target := &ServiceTarget{
+		Config: &TargetConfig{
+			Name: "service",
+			ServiceConfig: &ServiceConfig{
+				Endpoints: []string{"http://127.0.0.1:1/metrics"},
+			},
+		},
+	}
+	target.setState(DaemonStarting)
+	var buff bytes.Buffer
+	if err := target.Scrape(context.Background(), &buff); err == nil {
+		t.Error("Service not ready must fail without scraping")
+	}
+	if !strings.Contains(buff.String(), "### Err: Daemon is not ready") {
+		t.Errorf("Unexpected output: %s", buff.String())
+	}
+}
+
+func TestNewHealthCheck(t *testing.T) {
+	daemon := &ProcessConfig{Path: "/bin/true"}
+	if _, err := newHealthCheck("service", &HealthCheckConfig{TCP: "localhost:9100"}, nil, daemon); err != nil {
+		t.Errorf("Valid check rejected: %v", err)
+	}
+	if _, err := newHealthCheck("service", &HealthCheckConfig{}, nil, daemon); err == nil {
+		t.Error("Check without kind must be rejected")
+	}
+	if _, err := newHealthCheck("service", &HealthCheckConfig{TCP: "localhost:9100", HTTP: "http://localhost:9100/"}, nil, daemon); err == nil {
+		t.Error("Check with multiple kinds must be rejected")
+	}
+	for _, endpoint := range []string{"http://localhost:9100/", "https://localhost:9100/healthz", "unix:///run/exporter.sock:/healthz"} {
+		if _, err := newHealthCheck("service", &HealthCheckConfig{HTTP: endpoint}, nil, daemon); err != nil {
+			t.Errorf("Valid http check rejected: %s, %v", endpoint, err)
+		}
+	}
+	for _, endpoint := range []string{"localhost:9100", "/healthz", "ftp://localhost/", "http:///healthz", "unix://"} {
+		if _, err := newHealthCheck("service", &HealthCheckConfig{HTTP: endpoint}, nil, daemon); err == nil {
+			t.Errorf("Invalid http check must be rejected: %s", endpoint)
+		}
+	}
+}
+
+func TestServiceTargetAutoPort(t *testing.T) {
+	cfg, err := ReadTargetConfig([]byte(`
+name: exporter
+service:
+  path: /bin/true
+  args: ['--web.listen-address=127.0.0.1:{{ .Port }}']
+  port: auto
+  endpoints: ['http://127.0.0.1:{{ .Port }}/metrics']
+`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	target, err := newServiceTarget(cfg, false)
+	if err != nil {
+		t.Fatalf("Failed to make target: %v", err)
+	}
+	if target.port <= 0 || target.service.Endpoints[0] != fmt.Sprintf("http://127.0.0.1:%d/metrics", target.port) {
+		t.Errorf("Port not allocated: %d, %v", target.port, target.service.Endpoints)
+	}
+	if target, err = newServiceTarget(cfg, true); err != nil || target.port != 0 {
+		t.Errorf("Port must not be allocated for checking: %v", err)
+	}
+	cfg.ServiceConfig.Endpoints = []string{"http://127.0.0.1:{{- .Port }}/metrics"}
+	if _, err := newServiceTarget(cfg, false); err == nil {
+		t.Error("Target with an unknown port placeholder must be rejected")
+	}
+}
@@ -0,0 +1,117 @@
+package cradle
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// Watch reloads cradle automatically when the main config file or files in include_dirs change.
+// load is called to read the main config file again.
+// Bursts of changes are debounced by Config.WatchDebounce. It blocks until Shutdown is called.
+func (cradle *Cradle) Watch(configPath string, load func() (*Config, error)) error {
+	log := zap.L()
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = watcher.Close()
+	}()
+	configPath = filepath.Clean(configPath)
+	// Watch the dir instead of the file itself, because editors often replace the file.
+	configDir := filepath.Dir(configPath)
+	watched := make(map[string]bool)
+	included := cradle.syncWatchedDirs(watcher, watched, configDir)
+
+	debounce := time.NewTimer(0)
+	if !debounce.Stop() {
+		<-debounce.C
+	}
+	for {
+		select {
+		case <-cradle.haltCh:
+			debounce.Stop()
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if !included[filepath.Dir(event.Name)] && filepath.Clean(event.Name) != configPath {
+				// Other files next to the main config file.
+				continue
+			}
+			log.Debug("Change detected", zap.String("path", event.Name), zap.String("op", event.Op.String()))
+			// Drain the timer if it fired but has not been received yet, or Reset leaves the stale tick in the channel.
+			if !debounce.Stop() {
+				select {
+				case <-debounce.C:
+				default:
+				}
+			}
+			debounce.Reset(cradle.Config().WatchDebounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Warn("Error while watching config files", zap.Error(err))
+		case <-debounce.C:
+			if err := cradle.ReloadFrom(load); err == nil {
+				log.Info("Config reloaded automatically")
+			}
+			included = cradle.syncWatchedDirs(watcher, watched, configDir)
+		}
+	}
+}
+
+// syncWatchedDirs makes the watcher watch the dir of the main config file,
+// and all the include_dirs of the current config, recursively.
+// It returns the set of dirs in include_dirs.
+func (cradle *Cradle) syncWatchedDirs(watcher *fsnotify.Watcher, watched map[string]bool, configDir string) map[string]bool {
+	log := zap.L()
+	included := make(map[string]bool)
+	for _, dir := range cradle.Config().IncludeDirs {
+		// filepath.Walk does not follow the root if it is a symlink.
+		root, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			log.Warn("Failed to resolve include dir", zap.String("path", dir), zap.Error(err))
+			continue
+		}
+		_ = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				log.Warn("Failed to walk include dir", zap.String("path", path), zap.Error(err))
+				return nil
+			}
+			if info.IsDir() {
+				included[path] = true
+			}
+			return nil
+		})
+	}
+	dirs := map[string]bool{
+		configDir: true,
+	}
+	for dir := range included {
+		dirs[dir] = true
+	}
+	for dir := range watched {
+		if !dirs[dir] {
+			_ = watcher.Remove(dir)
+			delete(watched, dir)
+		}
+	}
+	for dir := range dirs {
+		if watched[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			log.Warn("Failed to watch dir", zap.String("path", dir), zap.Error(err))
+			continue
+		}
+		watched[dir] = true
+	}
+	return included
+}
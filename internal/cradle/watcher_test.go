@@ -0,0 +1,53 @@
+package cradle
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchIncludeDir(t *testing.T) {
+	// The include dir is a symlink, like /etc/cradle_exporter/conf.d managed by a config tool.
+	dir := t.TempDir()
+	include := filepath.Join(t.TempDir(), "conf.d")
+	if err := os.Symlink(dir, include); err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(t.TempDir(), "config.yml")
+	if err := ioutil.WriteFile(configPath, []byte("include_dirs: ['"+include+"']\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := ReadConfigFromFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Web.ListenAddress = "127.0.0.1:0"
+	config.WatchDebounce = 10 * time.Millisecond
+	cradle := New(config)
+	if err := cradle.Reload(config); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- cradle.Watch(configPath, func() (*Config, error) {
+			return config, nil
+		})
+	}()
+	defer func() {
+		_ = cradle.Shutdown()
+		if err := <-done; err != nil {
+			t.Errorf("Failed to watch: %v", err)
+		}
+	}()
+
+	// Keep writing until the watcher starts and picks it up.
+	waitFor(t, 5*time.Second, "the new target to be loaded", func() bool {
+		if err := ioutil.WriteFile(filepath.Join(dir, "node.yml"), []byte("static: {paths: []}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, ok := cradle.Targets()["node"]
+		return ok
+	})
+}